@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"sync/atomic"
+)
+
+// DefaultAdmissionSize is the default Cache.AdmissionSize.
+const DefaultAdmissionSize = 1 << 20
+
+// admissionWindow is the fraction of MaxBytes, as a divisor, that the
+// admission window holds. See admitWindow.
+const admissionWindow = 100
+
+// A sketch estimates how often keys have been fetched recently, in the style
+// of TinyLFU. It's a count-min sketch of four rows of 4-bit counters, in
+// front of which a doorkeeper bloom filter absorbs the first fetch of each key
+// so that one-hit wonders don't take up counters. Once the number of counted
+// fetches reaches ten times the sketch's width, all counters are halved and
+// the doorkeeper is cleared, so old popularity fades away.
+type sketch struct {
+	counters   [4][]uint8
+	doorkeeper []uint64
+	mask       uint64
+	additions  int
+	resetAt    int
+}
+
+// maxCount is the largest value of a 4-bit counter.
+const maxCount = 15
+
+// newSketch returns a sketch with room for about the given number of keys.
+func newSketch(size int) *sketch {
+	width := 64
+	for width < size {
+		width *= 2
+	}
+	s := &sketch{
+		doorkeeper: make([]uint64, width/64),
+		mask:       uint64(width - 1),
+		resetAt:    10 * width,
+	}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// hashKey returns the 64-bit FNV-1a hash of the given key.
+func hashKey(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// index returns the counter index for the given row. Rows use double hashing
+// with the two halves of the key's hash.
+func (s *sketch) index(h uint64, row int) uint64 {
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+// add counts a fetch of the key with the given hash.
+func (s *sketch) add(h uint64) {
+	if !s.doorkeeperAdd(h) {
+		return
+	}
+	for row := range s.counters {
+		if i := s.index(h, row); s.counters[row][i] < maxCount {
+			s.counters[row][i]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+// estimate returns the estimated number of recent fetches of the key with the
+// given hash.
+func (s *sketch) estimate(h uint64) int {
+	count := uint8(maxCount)
+	for row := range s.counters {
+		if c := s.counters[row][s.index(h, row)]; c < count {
+			count = c
+		}
+	}
+	if s.doorkeeperHas(h) {
+		count++
+	}
+	return int(count)
+}
+
+// doorkeeperAdd adds the key with the given hash to the doorkeeper and
+// returns true if it was already there.
+func (s *sketch) doorkeeperAdd(h uint64) bool {
+	had := true
+	for _, bit := range [2]uint64{h & s.mask, (h >> 32) & s.mask} {
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if s.doorkeeper[word]&mask == 0 {
+			had = false
+			s.doorkeeper[word] |= mask
+		}
+	}
+	return had
+}
+
+func (s *sketch) doorkeeperHas(h uint64) bool {
+	for _, bit := range [2]uint64{h & s.mask, (h >> 32) & s.mask} {
+		if s.doorkeeper[bit/64]&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reset halves all counters and clears the doorkeeper.
+func (s *sketch) reset() {
+	for row := range s.counters {
+		for i := range s.counters[row] {
+			s.counters[row][i] /= 2
+		}
+	}
+	for i := range s.doorkeeper {
+		s.doorkeeper[i] = 0
+	}
+	s.additions /= 2
+}
+
+// record counts a fetch of the given key for the admission policy.
+func (c *Cache) record(s *shard, key string) {
+	if !c.Admission {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.sketch == nil {
+		size := c.AdmissionSize
+		if size <= 0 {
+			size = DefaultAdmissionSize
+		}
+		s.sketch = newSketch(size / len(c.shards))
+	}
+	s.sketch.add(hashKey(key))
+}
+
+// frequency returns the estimated number of recent fetches of the given key.
+// The shard must be locked.
+func (s *shard) frequency(key string) int {
+	if s.sketch == nil {
+		return 0
+	}
+	return s.sketch.estimate(hashKey(key))
+}
+
+// admitWindow moves the least recently used object out of the admission
+// window. This is W-TinyLFU: with Admission, new keys are cached in a small
+// LRU window of 1/admissionWindow of MaxBytes, so that keys fetched a few
+// times in a burst get their hits, and only keys that outlive the window
+// compete for the rest of the cache on popularity. If the cache is over
+// MaxBytes, the object leaving the window is only kept if its key has been
+// fetched more often recently than the key of the object that would be
+// evicted in its place. Otherwise it's dropped and counted as a rejection.
+func (c *Cache) admitWindow() {
+	s := c.lruVictim(true)
+	if s == nil {
+		return
+	}
+	s.Lock()
+	back := s.window.Back()
+	if back == nil {
+		s.Unlock()
+		return
+	}
+	candidate := back.Value.(*cachedObject)
+	frequency := s.frequency(candidate.key)
+	s.Unlock()
+
+	admitted := true
+	if atomic.LoadInt64(&c.bytes) > int64(c.MaxBytes) {
+		if victim := c.lruVictim(false); victim != nil {
+			victim.Lock()
+			if back := victim.lru.Back(); back != nil {
+				key := back.Value.(*cachedObject).key
+				if admitted = frequency > victim.frequency(key); admitted {
+					c.unlink(victim, victim.m[key])
+					atomic.AddInt64(&c.Evictions, 1)
+				}
+			}
+			victim.Unlock()
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	element, ok := s.m[candidate.key]
+	if !ok || element.Value.(*cachedObject) != candidate || !candidate.inWindow {
+		// Replaced or removed in the meantime
+		return
+	}
+	if !admitted {
+		c.unlink(s, element)
+		atomic.AddInt64(&c.Rejections, 1)
+		return
+	}
+	s.window.Remove(candidate.lruElement)
+	atomic.AddInt64(&c.windowBytes, -int64(candidate.size))
+	candidate.inWindow = false
+	s.pushUsed(candidate)
+}
@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"github.com/stvp/resp"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSketch(t *testing.T) {
+	s := newSketch(1024)
+	hot, cold := hashKey("hot"), hashKey("cold")
+	if n := s.estimate(hot); n != 0 {
+		t.Errorf("expected 0, got: %d", n)
+	}
+
+	// The first fetch only goes to the doorkeeper
+	s.add(cold)
+	if n := s.estimate(cold); n != 1 {
+		t.Errorf("expected 1, got: %d", n)
+	}
+
+	for i := 0; i < 5; i++ {
+		s.add(hot)
+	}
+	if n := s.estimate(hot); n != 5 {
+		t.Errorf("expected 5, got: %d", n)
+	}
+	for i := 0; i < 100; i++ {
+		s.add(hot)
+	}
+	if n := s.estimate(hot); n != maxCount+1 {
+		t.Errorf("expected %d, got: %d", maxCount+1, n)
+	}
+
+	// Counts are halved and the doorkeeper cleared once enough fetches have
+	// been counted
+	s.resetAt = s.additions + 1
+	s.add(hot)
+	if n := s.estimate(hot); n != maxCount/2 {
+		t.Errorf("expected %d after reset, got: %d", maxCount/2, n)
+	}
+	if n := s.estimate(cold); n != 0 {
+		t.Errorf("expected 0 after reset, got: %d", n)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	value := resp.NewBulkString("value")
+	cache := NewShardedCache(1)
+	cache.MaxBytes = 2 * len(value.Raw())
+	cache.Admission = true
+	fill := func() (resp.Object, error) { return value, nil }
+
+	for i := 0; i < 3; i++ {
+		cache.Fetch("a", time.Now().Add(-time.Minute), fill)
+		cache.Fetch("b", time.Now().Add(-time.Minute), fill)
+	}
+
+	// A key fetched once doesn't evict more popular keys
+	cache.Fetch("once", time.Now().Add(-time.Minute), fill)
+	if _, ok := cache.Entry("once"); ok {
+		t.Error("expected \"once\" not to be cached")
+	}
+	if n := cache.Len(); n != 2 {
+		t.Errorf("expected 2 cached keys, got: %d", n)
+	}
+	if n := cache.Stats().Rejections; n != 1 {
+		t.Errorf("expected 1 rejection, got: %d", n)
+	}
+
+	// A key that becomes popular is admitted
+	for i := 0; i < 5; i++ {
+		cache.Fetch("c", time.Now().Add(-time.Minute), fill)
+	}
+	if _, ok := cache.Entry("c"); !ok {
+		t.Error("expected \"c\" to be cached")
+	}
+}
+
+func TestAdmissionWindow(t *testing.T) {
+	value := resp.NewBulkString("value")
+	cache := NewShardedCache(1)
+	cache.MaxBytes = 200 * len(value.Raw())
+	cache.Admission = true
+	fill := func() (resp.Object, error) { return value, nil }
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 200; j++ {
+			cache.Fetch(fmt.Sprintf("key:%d", j), time.Now().Add(-time.Minute), fill)
+		}
+	}
+
+	// A new key fetched in a burst is cached in the admission window
+	hits := cache.Stats().Hits
+	for i := 0; i < 3; i++ {
+		cache.Fetch("burst", time.Now().Add(-time.Minute), fill)
+	}
+	if n := cache.Stats().Hits - hits; n != 2 {
+		t.Errorf("expected 2 hits, got: %d", n)
+	}
+
+	// It's dropped once it leaves the window, since it's less popular
+	cache.Fetch("next", time.Now().Add(-time.Minute), fill)
+	cache.Fetch("last", time.Now().Add(-time.Minute), fill)
+	if _, ok := cache.Entry("burst"); ok {
+		t.Error("expected \"burst\" not to be cached")
+	}
+	if n := cache.Len(); n != 200 {
+		t.Errorf("expected 200 cached keys, got: %d", n)
+	}
+}
+
+// scanTrace returns a trace of keys from a small Zipf-distributed working set,
+// interrupted by scans of keys that are only fetched once.
+func scanTrace(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, 9999)
+	trace := make([]string, 0, n)
+	scans := 0
+	for len(trace) < n {
+		if r.Intn(100) == 0 {
+			for i := 0; i < 200; i++ {
+				trace = append(trace, fmt.Sprintf("scan:%d", scans))
+				scans++
+			}
+			continue
+		}
+		trace = append(trace, fmt.Sprintf("key:%d", zipf.Uint64()))
+	}
+	return trace[:n]
+}
+
+// recordedTrace returns the keys in testdata/buildcache.txt.gz: the 47,405
+// lookups that the go command made in its build cache, recorded through
+// GOCACHEPROG, while building, vetting and testing this repository 24 times
+// with a small edit to one of eight files before each round. Keys are action
+// IDs cut to 16 hex digits. It's a recorded key stream of a real cache, where
+// the same keys are looked up again on every round in a loop that is bigger
+// than a small cache, and every edit brings in keys that are looked up a few
+// times and then never again. It's not a trace of aorta itself.
+func recordedTrace(tb testing.TB) []string {
+	f, err := os.Open("testdata/buildcache.txt.gz")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var trace []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		trace = append(trace, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return trace
+}
+
+// hitRate replays the given trace against a Cache that fits the given number
+// of values and returns the fraction of fetches that were hits.
+func hitRate(trace []string, values int, admission bool) float64 {
+	value := resp.NewBulkString("value")
+	cache := NewCache()
+	cache.MaxBytes = values * len(value.Raw())
+	cache.Admission = admission
+	cache.AdmissionSize = 10 * values
+	for _, key := range trace {
+		cache.Fetch(key, time.Time{}, func() (resp.Object, error) {
+			return value, nil
+		})
+	}
+	stats := cache.Stats()
+	return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+}
+
+func TestAdmissionHitRate(t *testing.T) {
+	trace := scanTrace(200000)
+	lru := hitRate(trace, 500, false)
+	tinyLFU := hitRate(trace, 500, true)
+	if tinyLFU <= lru {
+		t.Errorf("expected a better hit rate with admission, got %.3f vs %.3f", tinyLFU, lru)
+	}
+}
+
+func TestAdmissionHitRate_Recorded(t *testing.T) {
+	trace := recordedTrace(t)
+	for _, values := range []int{100, 500, 1000} {
+		lru := hitRate(trace, values, false)
+		tinyLFU := hitRate(trace, values, true)
+		if tinyLFU <= lru {
+			t.Errorf("%d values: expected a better hit rate with admission, got %.3f vs %.3f", values, tinyLFU, lru)
+		}
+	}
+}
+
+func BenchmarkHitRate_LRU(b *testing.B) {
+	benchmarkHitRate(b, scanTrace(100000), false)
+}
+
+func BenchmarkHitRate_Admission(b *testing.B) {
+	benchmarkHitRate(b, scanTrace(100000), true)
+}
+
+func BenchmarkHitRate_Recorded_LRU(b *testing.B) {
+	benchmarkHitRate(b, recordedTrace(b), false)
+}
+
+func BenchmarkHitRate_Recorded_Admission(b *testing.B) {
+	benchmarkHitRate(b, recordedTrace(b), true)
+}
+
+func benchmarkHitRate(b *testing.B, trace []string, admission bool) {
+	b.ResetTimer()
+	var rate float64
+	for i := 0; i < b.N; i++ {
+		rate = hitRate(trace, 500, admission)
+	}
+	b.ReportMetric(100*rate, "hit%")
+}
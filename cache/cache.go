@@ -2,136 +2,780 @@ package cache
 
 import (
 	"container/list"
+	"context"
 	"github.com/stvp/resp"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultShards is the number of shards used by NewCache.
+const DefaultShards = 64
+
 // A Cache is a simple cache for RESP objects with string keys. The primary
 // goal is to ensure that the cache fill function for a given key is never
 // called more often than needed. If you continually call Fetch() with a max
 // age of 1 second ago, the cache fill function will never be called more than
 // once a second regardless of whether the cache fill function is fast or slow
 // for a given key. If a cache fill for a key is slow, simultaneous Fetch()
-// calls for that key will block until the cache is filled.
+// calls for that key will block until the cache is filled, or until MaxWait.
+//
+// Cache is designed to hold up to multiple millions of keys. The overhead for a
+// million keys shouldn't be more than 16-32 megabytes. The size of the cached
+// objects themselves can be limited with MaxBytes.
 //
-// Cache is designed to hold up to multiple millions of keys. Memory efficiency
-// is not a goal, but the overhead for a million keys shouldn't be more than
-// 16-32 megabytes.
+// Keys are spread over a number of shards that are locked independently, so
+// Fetch calls for different keys rarely wait for each other. All methods are
+// safe for concurrent use. The stats counters are updated atomically and should
+// be read with atomic.LoadInt64 or Stats.
 type Cache struct {
-	Hits   int
-	Misses int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+
+	// Stale-while-revalidate stats. See FetchStale.
+	StaleHits        int64
+	RevalidateErrors int64
+
+	// StaleIfError, if set, is called with the error from a failed cache fill.
+	// If it returns true and the key has a cached value that's not older than
+	// MaxStale, the cached value is returned instead of the error.
+	StaleIfError   func(error) bool
+	MaxStale       time.Duration
+	StaleErrorHits int64
+
+	// MaxWait, if set, limits how long Fetch waits for a simultaneous cache
+	// fill of the same key before giving up with ErrWaitTimeout, and
+	// FillTimeout limits how long a cache fill can take before Fetch gives up
+	// with ErrFillTimeout. Either error can be replaced by a stale value with
+	// StaleIfError. WaitTimeouts and FillTimeouts count them. Fetch stops
+	// waiting for a fill that times out, but can't stop the fill itself, so
+	// the fill function may still run to completion (e.g. its command may
+	// still run on a Redis server) after Fetch has returned the error.
+	MaxWait      time.Duration
+	FillTimeout  time.Duration
+	WaitTimeouts int64
+	FillTimeouts int64
+
+	// Invalidations counts cached values removed by InvalidateTag.
+	Invalidations int64
+
+	// IsNegative, if set, reports whether an object is a negative result, like
+	// a reply for a missing key. Negative values are never returned once
+	// they're older than NegativeMaxAge, even if Fetch is given an older max
+	// age, and hits on them are counted in NegativeHits instead of Hits.
+	IsNegative     func(resp.Object) bool
+	NegativeMaxAge time.Duration
+	NegativeHits   int64
+
+	// MaxBytes is the maximum total size of all cached objects, measured by
+	// the size of their raw RESP. When a cache fill goes over the limit, the
+	// least recently used objects are evicted. Zero means no limit.
+	MaxBytes int
+
+	// RefreshAhead, if greater than zero, enables refresh-ahead for hot keys.
+	// See Refresh.
+	RefreshAhead       float64
+	RefreshMinHits     int
+	RefreshColdAfter   time.Duration
+	RefreshConcurrency int
+	Refreshes          int64
+
+	// Codec, if set, compresses cached objects of at least CompressMinBytes.
+	// Compressed objects count towards MaxBytes by their compressed size and
+	// are decompressed on each hit. CompressedIn and CompressedOut count the
+	// bytes before and after compression, and CompressNanos and
+	// DecompressNanos the time spent compressing and decompressing.
+	Codec            Codec
+	CompressMinBytes int
+	CompressedIn     int64
+	CompressedOut    int64
+	CompressNanos    int64
+	DecompressNanos  int64
 
-	l            list.List
-	m            map[string]*list.Element
-	mutexes      map[string]*sync.Mutex
-	mutexesMutex sync.Mutex
+	// Admission, if set along with MaxBytes, keeps keys that are rarely
+	// fetched from evicting more popular ones. See admitWindow. AdmissionSize
+	// is roughly the number of keys whose popularity is tracked (default:
+	// DefaultAdmissionSize), and Rejections counts objects that were dropped
+	// from the admission window instead of evicting a more popular object.
+	Admission     bool
+	AdmissionSize int
+	Rejections    int64
+
+	bytes        int64
+	windowBytes  int64 // see admitWindow
+	shards       []*shard
+	refreshOnce  sync.Once
+	refreshSlots chan bool
+
+	// onRemove, if set, is called with each object removed from the cache,
+	// with the object's shard locked.
+	onRemove func(resp.Object)
+}
+
+// A shard holds the cached values for a subset of keys. Everything in a shard
+// is guarded by its mutex, which is only held briefly; cache fill functions
+// run with only their key's lock held.
+type shard struct {
+	sync.Mutex
+	l      list.List // newest first
+	lru    list.List // most recently used first
+	window list.List // admission window, most recently used first
+	m      map[string]*list.Element
+	tags   map[string]map[string]bool // tag -> keys
+	locks  map[string]*keyLock
+	hot    map[string]*cachedObject
+
+	sketch *sketch // see Cache.Admission
+}
+
+// A keyLock serializes cache fills for a key. refs counts the holder and
+// waiters so that the lock can be forgotten once nobody is using it.
+type keyLock struct {
+	ch   chan bool
+	refs int
 }
 
 type cachedObject struct {
-	key       string
-	object    resp.Object
-	timestamp time.Time
+	key          string
+	object       resp.Object
+	timestamp    time.Time
+	used         time.Time
+	size         int
+	lruElement   *list.Element
+	inWindow     bool // lruElement is in the shard's window, not its lru
+	revalidating bool
+	tags         []string
+	expires      time.Time   // see ExpiringObject
+	negative     bool        // see IsNegative
+	timer        *time.Timer // removes the value when it expires
+
+	// Refresh-ahead state. See Refresh.
+	fetches   int
+	fetched   time.Time
+	fetchAge  time.Duration
+	refreshFn func() (resp.Object, error)
 }
 
-// NewCache returns an initialized Cache, ready for use.
+// NewCache returns an initialized Cache with DefaultShards shards, ready for
+// use.
 func NewCache() *Cache {
-	return &Cache{
-		m:       make(map[string]*list.Element),
-		mutexes: make(map[string]*sync.Mutex),
+	return NewShardedCache(DefaultShards)
+}
+
+// NewShardedCache returns an initialized Cache with the given number of
+// shards. More shards allow more concurrent use, but MaxBytes eviction and
+// Expire are only approximately oldest-first across shards.
+func NewShardedCache(shards int) *Cache {
+	if shards < 1 {
+		shards = 1
 	}
+	c := &Cache{shards: make([]*shard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			m:     make(map[string]*list.Element),
+			tags:  make(map[string]map[string]bool),
+			locks: make(map[string]*keyLock),
+			hot:   make(map[string]*cachedObject),
+		}
+	}
+	return c
+}
+
+// shard returns the shard for the given key using the FNV-1a hash.
+func (c *Cache) shard(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
 }
 
 // Fetch takes a key and returns the cached value, if the key is cached and is
 // not older than the given time.Time. If the key is not cached, the given
 // cache fill function will be called to fill the cache. If the cache fill
 // function returns an error, the cache will not be filled and the error will
-// be returned by Fetch.
+// be returned by Fetch. With RefreshAhead, the fill function may be called
+// again later in the background to refresh the key.
 func (c *Cache) Fetch(key string, maxAge time.Time, fn func() (resp.Object, error)) (resp.Object, error) {
-	c.lockKey(key)
-	defer c.unlockKey(key)
+	return c.FetchContext(context.Background(), key, maxAge, fn)
+}
+
+// FetchContext is like Fetch but gives up waiting for a simultaneous Fetch
+// of the same key when the given context is done, returning the context's
+// error. The context isn't passed to the cache fill function; fill functions
+// that should be canceled too need to use the context themselves.
+func (c *Cache) FetchContext(ctx context.Context, key string, maxAge time.Time, fn func() (resp.Object, error)) (resp.Object, error) {
+	s := c.shard(key)
+	c.record(s, key)
+
+	// Try to use cached value. Hits don't need the key's lock.
+	if obj, ok := c.get(s, key, maxAge, fn); ok {
+		return c.decompressObject(obj)
+	}
+
+	lock, err := c.lockKeyWait(ctx, s, key)
+	if err == ErrWaitTimeout {
+		if stale, ok := c.staleIfError(s, key, err); ok {
+			return c.decompressObject(stale)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var orphaned bool
+	defer func() {
+		// A fill that timed out unlocks the key once it's done instead
+		if !orphaned {
+			s.unlockKey(key, lock)
+		}
+	}()
 
-	// Try to use cached value
-	element, ok := c.m[key]
+	// The cache may have been filled while waiting for the lock
+	if obj, ok := c.get(s, key, maxAge, fn); ok {
+		return c.decompressObject(obj)
+	}
+
+	atomic.AddInt64(&c.Misses, 1)
+
+	// Cache is empty or stale, fill it up. If the fill times out, the key
+	// stays locked until it's done, so that callers waiting for the key share
+	// its late result instead of starting another fill.
+	object, err := c.callFill(s, fn, func(result fillResult) {
+		defer s.unlockKey(key, lock)
+		if result.err == nil {
+			c.store(s, key, result.object)
+		}
+	})
+	orphaned = err == ErrFillTimeout
+	if err != nil {
+		if stale, ok := c.staleIfError(s, key, err); ok {
+			return c.decompressObject(stale)
+		}
+		return object, err
+	}
+
+	value := c.store(s, key, object)
+	s.Lock()
+	c.noteFetch(s, value, maxAge, fn)
+	s.Unlock()
+	object, _, _ = unwrapFill(object)
+	return object, nil
+}
+
+// Get returns the cached value for the given key if it's cached and not older
+// than the given time.Time. Unlike Fetch, it never waits for a cache fill.
+func (c *Cache) Get(key string, maxAge time.Time) (resp.Object, bool) {
+	s := c.shard(key)
+	c.record(s, key)
+	obj, ok := c.get(s, key, maxAge, nil)
+	if !ok {
+		atomic.AddInt64(&c.Misses, 1)
+		return nil, false
+	}
+	obj, err := c.decompressObject(obj)
+	if err != nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+// Set caches the given object for the given key, replacing any existing value.
+// The key isn't locked, so Set doesn't wait for a simultaneous cache fill. Use
+// Fetch to fill the cache unless the value has been fetched some other way.
+func (c *Cache) Set(key string, object resp.Object) {
+	c.store(c.shard(key), key, object)
+}
+
+// staleIfError returns the cached value for the given key if the StaleIfError
+// policy allows it to be used in place of the given error.
+func (c *Cache) staleIfError(s *shard, key string, err error) (resp.Object, bool) {
+	if c.StaleIfError == nil {
+		return nil, false
+	}
+	s.Lock()
+	element, ok := s.m[key]
+	var obj *cachedObject
 	if ok {
+		obj = element.Value.(*cachedObject)
+	}
+	s.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if obj.timestamp.Before(time.Now().Add(-c.MaxStale)) || obj.expired(time.Now()) || !c.StaleIfError(err) {
+		return nil, false
+	}
+	atomic.AddInt64(&c.StaleErrorHits, 1)
+	return obj.object, true
+}
+
+// FetchStale is like Fetch, but a cached value that's older than maxAge and
+// not older than staleAge is returned right away instead of waiting for a
+// cache fill. The cache is then filled in the background. Only one background
+// fill runs for a key at a time. Errors from background fills are counted in
+// RevalidateErrors but otherwise ignored.
+func (c *Cache) FetchStale(key string, maxAge, staleAge time.Time, fn func() (resp.Object, error)) (resp.Object, error) {
+	return c.FetchStaleContext(context.Background(), key, maxAge, staleAge, fn)
+}
+
+// FetchStaleContext is like FetchStale but gives up waiting for a
+// simultaneous Fetch of the same key when the given context is done. See
+// FetchContext.
+func (c *Cache) FetchStaleContext(ctx context.Context, key string, maxAge, staleAge time.Time, fn func() (resp.Object, error)) (resp.Object, error) {
+	// Stale hits don't need the key's lock, so they don't wait for a
+	// simultaneous cache fill
+	s := c.shard(key)
+	s.Lock()
+	if element, ok := s.m[key]; ok {
 		obj := element.Value.(*cachedObject)
-		if obj.timestamp.After(maxAge) {
-			c.Hits++
-			return obj.object, nil
+		if !obj.timestamp.After(maxAge) && obj.timestamp.After(staleAge) && !obj.expired(time.Now()) && !obj.negative {
+			s.use(obj)
+			c.noteFetch(s, obj, maxAge, fn)
+			revalidate := !obj.revalidating
+			obj.revalidating = true
+			s.Unlock()
+
+			atomic.AddInt64(&c.StaleHits, 1)
+			c.record(s, key)
+			if revalidate {
+				go c.revalidate(key, obj, fn)
+			}
+			return c.decompressObject(obj.object)
 		}
 	}
+	s.Unlock()
 
-	c.Misses++
+	return c.FetchContext(ctx, key, maxAge, fn)
+}
+
+// revalidate fills the cache for the given key in the background. The key
+// isn't locked while the cache fill function runs.
+func (c *Cache) revalidate(key string, stale *cachedObject, fn func() (resp.Object, error)) {
+	s := c.shard(key)
+	object, err := c.callFill(s, fn, nil)
+
+	lock := s.lockKey(key)
+	defer s.unlockKey(key, lock)
 
-	// Cache is empty or stale, fill it up
-	object, err := fn()
 	if err != nil {
-		return object, err
+		atomic.AddInt64(&c.RevalidateErrors, 1)
+		s.Lock()
+		stale.revalidating = false
+		s.Unlock()
+		return
 	}
 
+	// Don't overwrite a newer value from a simultaneous Fetch, or bring back a
+	// value that was removed (e.g. invalidated by a write) during the fill
+	s.Lock()
+	element, ok := s.m[key]
+	current := ok && element.Value.(*cachedObject) == stale
+	s.Unlock()
+	if current {
+		c.store(s, key, object)
+	}
+}
+
+// store adds the given object to the cache, replacing any existing value for
+// the key and keeping its tags and refresh-ahead state, and then evicts
+// objects if the cache is over MaxBytes. The tags of a TaggedObject are added
+// along with it. The object is compressed first if there's a Codec. With
+// Admission, a new key's object goes into the admission window and may be
+// dropped again by evict (see admitWindow).
+func (c *Cache) store(s *shard, key string, object resp.Object) *cachedObject {
+	object, expires, newTags := unwrapFill(object)
+	negative := c.isNegative(object)
+	object = c.compress(object)
+	size := objectSize(object)
+
+	now := time.Now()
 	value := &cachedObject{
 		key:       key,
 		object:    object,
-		timestamp: time.Now(),
+		timestamp: now,
+		used:      now,
+		size:      size,
+		expires:   expires,
+		negative:  negative,
+		inWindow:  c.Admission && c.MaxBytes > 0,
 	}
-	c.m[key] = c.l.PushFront(value)
 
-	return object, nil
+	s.Lock()
+	var tags []string
+	if element, ok := s.m[key]; ok {
+		old := element.Value.(*cachedObject)
+		tags = old.tags
+		value.inWindow = old.inWindow
+		value.keepRefresh(s, old)
+		c.unlink(s, element)
+	}
+	s.pushUsed(value)
+	if value.inWindow {
+		atomic.AddInt64(&c.windowBytes, int64(value.size))
+	}
+	s.m[key] = s.l.PushFront(value)
+	s.addTags(value, tags)
+	s.addTags(value, newTags)
+	c.expireLater(s, value)
+	s.Unlock()
+
+	atomic.AddInt64(&c.bytes, int64(value.size))
+	c.evict()
+	return value
+}
+
+// get returns the cached value for the given key if it's not older than the
+// given time.Time, marks it as used and counts the hit.
+func (c *Cache) get(s *shard, key string, maxAge time.Time, fn func() (resp.Object, error)) (resp.Object, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	element, ok := s.m[key]
+	if !ok {
+		return nil, false
+	}
+	obj := element.Value.(*cachedObject)
+	if !obj.timestamp.After(c.maxAge(obj, maxAge)) || obj.expired(time.Now()) {
+		return nil, false
+	}
+	s.use(obj)
+	c.noteFetch(s, obj, maxAge, fn)
+	if obj.negative {
+		atomic.AddInt64(&c.NegativeHits, 1)
+	} else {
+		atomic.AddInt64(&c.Hits, 1)
+	}
+	return obj.object, true
+}
+
+// objectSize returns the size of the given object's raw RESP. Objects that
+// aren't kept in memory (see DiskCache) report their own size.
+func objectSize(object resp.Object) int {
+	if sized, ok := object.(interface {
+		Size() int
+	}); ok {
+		return sized.Size()
+	}
+	return len(object.Raw())
+}
+
+// use marks the given object as the most recently used. The shard must be
+// locked.
+func (s *shard) use(obj *cachedObject) {
+	obj.used = time.Now()
+	s.lruList(obj.inWindow).MoveToFront(obj.lruElement)
+}
+
+// lruList returns the shard's admission window if window is set, and its lru
+// otherwise.
+func (s *shard) lruList(window bool) *list.List {
+	if window {
+		return &s.window
+	}
+	return &s.lru
+}
+
+// pushUsed adds the given object to the front of its lruList. The shard must
+// be locked.
+func (s *shard) pushUsed(obj *cachedObject) {
+	obj.lruElement = s.lruList(obj.inWindow).PushFront(obj)
+}
+
+// Tag attaches the given tags to the cached value for the given key, if
+// there is one. Tags are kept when the value is refilled and are removed along
+// with the value. To tag a value as it's filled, return a TaggedObject from
+// the fill function instead.
+func (c *Cache) Tag(key string, tags ...string) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if element, ok := s.m[key]; ok {
+		s.addTags(element.Value.(*cachedObject), tags)
+	}
+}
+
+// InvalidateTag removes all cached values with the given tag and returns the
+// number of values removed. Keys aren't locked, so a simultaneous Fetch for an
+// invalidated key will simply fill it again.
+func (c *Cache) InvalidateTag(tag string) (invalidated int) {
+	for _, s := range c.shards {
+		s.Lock()
+		for key := range s.tags[tag] {
+			if element, ok := s.m[key]; ok {
+				c.unlink(s, element)
+				invalidated++
+			}
+		}
+		s.Unlock()
+	}
+	atomic.AddInt64(&c.Invalidations, int64(invalidated))
+	return invalidated
+}
+
+// addTags attaches the given tags to the given value. The shard must be
+// locked.
+func (s *shard) addTags(value *cachedObject, tags []string) {
+	for _, tag := range tags {
+		keys, ok := s.tags[tag]
+		if !ok {
+			keys = make(map[string]bool)
+			s.tags[tag] = keys
+		}
+		if !keys[value.key] {
+			keys[value.key] = true
+			value.tags = append(value.tags, tag)
+		}
+	}
 }
 
 // Expire is an exact expiration loop that expires all keys (up to a given
 // maximum count) that are older than the given time.Time. It expires the
-// oldest values first, and returns the number of values that were expired.
-// It's moderately fast: on a MacBook Pro, it expires ~2,000 items per
-// millisecond.
+// oldest values in each shard first, and returns the number of values that
+// were expired. It's moderately fast: on a MacBook Pro, it expires ~2,000
+// items per millisecond.
 func (c *Cache) Expire(maxCount int, maxAge time.Time) (expired int) {
-	var v *cachedObject
-	var cursor, prev *list.Element
-	cursor = c.l.Back()
+	for _, s := range c.shards {
+		s.Lock()
+		for cursor := s.l.Back(); cursor != nil; cursor = s.l.Back() {
+			if maxCount > 0 && expired == maxCount {
+				break
+			}
+			if cursor.Value.(*cachedObject).timestamp.After(maxAge) {
+				break
+			}
+			c.unlink(s, cursor)
+			expired++
+		}
+		s.Unlock()
+	}
+	return expired
+}
 
-	for cursor != nil {
-		v = cursor.Value.(*cachedObject)
-		if v.timestamp.After(maxAge) {
-			break
+// An Entry describes a cached value. See Entries.
+type Entry struct {
+	Key       string
+	Timestamp time.Time
+	Expires   time.Time // zero if the value doesn't expire
+	Size      int
+	Tags      []string
+}
+
+// Entries returns all cached values with the given tag, or all cached values
+// if the tag is empty, newest first. It's meant for debugging; it doesn't
+// count as a use of the values.
+func (c *Cache) Entries(tag string) []Entry {
+	var entries []Entry
+	for _, s := range c.shards {
+		s.Lock()
+		for e := s.l.Front(); e != nil; e = e.Next() {
+			value := e.Value.(*cachedObject)
+			if len(tag) > 0 && !s.tags[tag][value.key] {
+				continue
+			}
+			entries = append(entries, value.entry())
 		}
-		prev = cursor.Prev()
-		c.remove(cursor)
-		cursor = prev
-		expired++
-		if maxCount > 0 && expired == maxCount {
-			break
+		s.Unlock()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.After(entries[j].Timestamp)
+	})
+	return entries
+}
+
+// Entry returns the Entry for the given key, if it's cached. Like Entries, it
+// doesn't count as a use of the value.
+func (c *Cache) Entry(key string) (Entry, bool) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	element, ok := s.m[key]
+	if !ok {
+		return Entry{}, false
+	}
+	return element.Value.(*cachedObject).entry(), true
+}
+
+func (v *cachedObject) entry() Entry {
+	return Entry{
+		Key:       v.key,
+		Timestamp: v.timestamp,
+		Expires:   v.expires,
+		Size:      v.size,
+		Tags:      append([]string(nil), v.tags...),
+	}
+}
+
+// Delete removes the given keys from the cache and returns the number of
+// keys removed.
+func (c *Cache) Delete(keys ...string) (deleted int) {
+	for _, key := range keys {
+		s := c.shard(key)
+		s.Lock()
+		if element, ok := s.m[key]; ok {
+			c.unlink(s, element)
+			deleted++
 		}
+		s.Unlock()
 	}
+	return deleted
+}
 
-	return expired
+// Flush removes everything from the cache and returns the number of keys
+// removed.
+func (c *Cache) Flush() (flushed int) {
+	for _, s := range c.shards {
+		s.Lock()
+		for e := s.l.Back(); e != nil; e = s.l.Back() {
+			c.unlink(s, e)
+			flushed++
+		}
+		s.Unlock()
+	}
+	return flushed
 }
 
 // Len returns the number of keys in the cache.
 func (c *Cache) Len() (count int) {
-	return len(c.m)
+	for _, s := range c.shards {
+		s.Lock()
+		count += len(s.m)
+		s.Unlock()
+	}
+	return count
 }
 
-func (c *Cache) remove(e *list.Element) {
+// Bytes returns the total size of all cached objects. See MaxBytes.
+func (c *Cache) Bytes() int {
+	return int(atomic.LoadInt64(&c.bytes))
+}
+
+// evict removes the least recently used objects until the cache is within
+// MaxBytes. Each eviction picks the shard whose least recently used object is
+// the oldest. Only one shard is locked at a time. Evicted keys aren't locked,
+// so a simultaneous Fetch for an evicted key will simply fill it again. With
+// Admission, objects leaving the admission window are admitted or dropped
+// first (see admitWindow), and the window is only evicted from directly once
+// the rest of the cache is empty.
+func (c *Cache) evict() {
+	if c.MaxBytes <= 0 {
+		return
+	}
+	for {
+		if atomic.LoadInt64(&c.windowBytes) > int64(c.MaxBytes/admissionWindow) {
+			c.admitWindow()
+			continue
+		}
+		if atomic.LoadInt64(&c.bytes) <= int64(c.MaxBytes) {
+			return
+		}
+
+		window := false
+		victim := c.lruVictim(false)
+		if victim == nil {
+			window = true
+			if victim = c.lruVictim(true); victim == nil {
+				return
+			}
+		}
+
+		victim.Lock()
+		if back := victim.lruList(window).Back(); back != nil {
+			c.unlink(victim, victim.m[back.Value.(*cachedObject).key])
+			atomic.AddInt64(&c.Evictions, 1)
+		}
+		victim.Unlock()
+	}
+}
+
+// lruVictim returns the shard whose least recently used object is the oldest,
+// or nil if the cache is empty. If window is set, only objects in the
+// admission window are considered, and otherwise only the others.
+func (c *Cache) lruVictim(window bool) (victim *shard) {
+	var oldest time.Time
+	for _, s := range c.shards {
+		s.Lock()
+		if back := s.lruList(window).Back(); back != nil {
+			used := back.Value.(*cachedObject).used
+			if victim == nil || used.Before(oldest) {
+				victim, oldest = s, used
+			}
+		}
+		s.Unlock()
+	}
+	return victim
+}
+
+// unlink removes the given element from the cache. The shard must be locked.
+func (c *Cache) unlink(s *shard, e *list.Element) {
 	value := e.Value.(*cachedObject)
-	c.lockKey(value.key)
-	c.l.Remove(e)
-	delete(c.m, value.key)
-	c.mutexesMutex.Lock()
-	delete(c.mutexes, value.key)
-	c.mutexesMutex.Unlock()
+	s.l.Remove(e)
+	s.lruList(value.inWindow).Remove(value.lruElement)
+	if value.inWindow {
+		atomic.AddInt64(&c.windowBytes, -int64(value.size))
+	}
+	delete(s.m, value.key)
+	if s.hot[value.key] == value {
+		delete(s.hot, value.key)
+	}
+	if value.timer != nil {
+		value.timer.Stop()
+	}
+	atomic.AddInt64(&c.bytes, -int64(value.size))
+	if c.onRemove != nil {
+		c.onRemove(value.object)
+	}
+	for _, tag := range value.tags {
+		delete(s.tags[tag], value.key)
+		if len(s.tags[tag]) == 0 {
+			delete(s.tags, tag)
+		}
+	}
 }
 
-func (c *Cache) lockKey(key string) {
-	c.mutexesMutex.Lock()
-	mutex, ok := c.mutexes[key]
+func (s *shard) lockKey(key string) *keyLock {
+	lock, _ := s.lockKeyContext(context.Background(), key)
+	return lock
+}
+
+// lockKeyContext locks the given key, or returns the context's error if the
+// context is done first. Each key's lock is a channel with a buffer of one.
+func (s *shard) lockKeyContext(ctx context.Context, key string) (*keyLock, error) {
+	s.Lock()
+	lock, ok := s.locks[key]
 	if !ok {
-		mutex = &sync.Mutex{}
-		c.mutexes[key] = mutex
+		lock = &keyLock{ch: make(chan bool, 1)}
+		s.locks[key] = lock
 	}
-	c.mutexesMutex.Unlock()
-	mutex.Lock()
+	lock.refs++
+	s.Unlock()
+
+	select {
+	case lock.ch <- true:
+		return lock, nil
+	case <-ctx.Done():
+		s.release(key, lock)
+		return nil, ctx.Err()
+	}
+}
+
+// unlockKey unlocks the given key's lock.
+func (s *shard) unlockKey(key string, lock *keyLock) {
+	<-lock.ch
+	s.release(key, lock)
 }
 
-func (c *Cache) unlockKey(key string) {
-	c.mutexes[key].Unlock()
+// release drops a reference to the given key's lock and forgets the lock if
+// nobody else is holding or waiting for it.
+func (s *shard) release(key string, lock *keyLock) {
+	s.Lock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(s.locks, key)
+	}
+	s.Unlock()
 }
@@ -1,13 +1,44 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 	"github.com/stvp/resp"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// -- Helpers
+
+func setTimestamp(cache *Cache, key string, timestamp time.Time) {
+	s := cache.shard(key)
+	s.Lock()
+	s.m[key].Value.(*cachedObject).timestamp = timestamp
+	s.Unlock()
+}
+
+func tagCount(cache *Cache) (count int) {
+	for _, s := range cache.shards {
+		s.Lock()
+		count += len(s.tags)
+		s.Unlock()
+	}
+	return count
+}
+
+func lockCount(cache *Cache) (count int) {
+	for _, s := range cache.shards {
+		s.Lock()
+		count += len(s.locks)
+		s.Unlock()
+	}
+	return count
+}
+
+// -- Tests
+
 func TestCacheFetch(t *testing.T) {
 	now := time.Now()
 	secondAgo := now.Add(-time.Second)
@@ -68,6 +99,163 @@ func TestCacheFetch(t *testing.T) {
 	}
 }
 
+func TestCacheFetchContext(t *testing.T) {
+	cache := NewCache()
+
+	// Start a slow cache fill
+	filling := make(chan bool)
+	release := make(chan bool)
+	go cache.Fetch("slowkey", time.Now(), func() (resp.Object, error) {
+		close(filling)
+		<-release
+		return resp.NewBulkString("slow"), nil
+	})
+	<-filling
+
+	// Waiters give up when their context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := cache.FetchContext(ctx, "slowkey", time.Now(), func() (resp.Object, error) {
+		t.Error("FetchContext called the fill function while another fill was running")
+		return nil, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got: %#v", err)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Errorf("waiter wasn't released promptly, waited %s", waited)
+	}
+
+	// The slow fill finishes and the key is still usable
+	close(release)
+	obj, err := cache.Fetch("slowkey", time.Now().Add(-time.Minute), func() (resp.Object, error) {
+		t.Error("Fetch called the fill function when the key was already cached")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.(resp.String).String() != "slow" {
+		t.Errorf("Fetch() returned the wrong object: %#v", obj)
+	}
+}
+
+func TestCacheFetchStale(t *testing.T) {
+	cache := NewCache()
+	cache.Fetch("mykey", time.Now(), func() (resp.Object, error) {
+		return resp.NewBulkString("old"), nil
+	})
+	setTimestamp(cache, "mykey", time.Now().Add(-time.Minute))
+
+	// Stale values within the grace period are returned right away
+	fills := make(chan bool, 2)
+	release := make(chan bool)
+	for i := 0; i < 2; i++ {
+		obj, err := cache.FetchStale("mykey", time.Now().Add(-time.Second), time.Now().Add(-time.Hour), func() (resp.Object, error) {
+			fills <- true
+			<-release
+			return resp.NewBulkString("new"), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.(resp.String).String() != "old" {
+			t.Errorf("FetchStale() returned the wrong object: %#v", obj)
+		}
+	}
+	close(release)
+	<-fills
+	time.Sleep(10 * time.Millisecond)
+	if len(fills) != 0 {
+		t.Error("FetchStale() should only run one background fill at a time")
+	}
+	if atomic.LoadInt64(&cache.StaleHits) != 2 {
+		t.Errorf("expected 2 stale hits, got: %d", atomic.LoadInt64(&cache.StaleHits))
+	}
+	obj, _ := cache.Fetch("mykey", time.Now().Add(-time.Second), func() (resp.Object, error) {
+		t.Error("Fetch called the fill function when the key was already revalidated")
+		return nil, nil
+	})
+	if obj.(resp.String).String() != "new" {
+		t.Errorf("background fill didn't update the cache: %#v", obj)
+	}
+
+	// Background fill errors are counted but not returned
+	setTimestamp(cache, "mykey", time.Now().Add(-time.Minute))
+	obj, err := cache.FetchStale("mykey", time.Now().Add(-time.Second), time.Now().Add(-time.Hour), func() (resp.Object, error) {
+		return nil, fmt.Errorf("oh no")
+	})
+	if err != nil {
+		t.Errorf("FetchStale() returned a background fill error: %#v", err)
+	}
+	if obj.(resp.String).String() != "new" {
+		t.Errorf("FetchStale() returned the wrong object: %#v", obj)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt64(&cache.RevalidateErrors) != 1 {
+		t.Errorf("expected 1 revalidate error, got: %d", atomic.LoadInt64(&cache.RevalidateErrors))
+	}
+
+	// Values older than the grace period are filled before returning
+	setTimestamp(cache, "mykey", time.Now().Add(-2*time.Hour))
+	obj, err = cache.FetchStale("mykey", time.Now().Add(-time.Second), time.Now().Add(-time.Hour), func() (resp.Object, error) {
+		return resp.NewBulkString("newest"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.(resp.String).String() != "newest" {
+		t.Errorf("FetchStale() returned the wrong object: %#v", obj)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	errConn := fmt.Errorf("connection error")
+	errRedis := fmt.Errorf("redis error")
+
+	cache := NewCache()
+	cache.MaxStale = time.Minute
+	cache.StaleIfError = func(err error) bool { return err == errConn }
+	cache.Fetch("mykey", time.Now(), func() (resp.Object, error) {
+		return resp.NewBulkString("good"), nil
+	})
+
+	// Connection errors return the last good value
+	obj, err := cache.Fetch("mykey", time.Now(), func() (resp.Object, error) {
+		return nil, errConn
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.(resp.String).String() != "good" {
+		t.Errorf("Fetch() returned the wrong object: %#v", obj)
+	}
+	if atomic.LoadInt64(&cache.StaleErrorHits) != 1 {
+		t.Errorf("expected 1 stale error hit, got: %d", atomic.LoadInt64(&cache.StaleErrorHits))
+	}
+
+	// Other errors are returned
+	_, err = cache.Fetch("mykey", time.Now(), func() (resp.Object, error) {
+		return nil, errRedis
+	})
+	if err != errRedis {
+		t.Errorf("expected redis error, got: %#v", err)
+	}
+
+	// Values older than MaxStale aren't used
+	setTimestamp(cache, "mykey", time.Now().Add(-time.Hour))
+	_, err = cache.Fetch("mykey", time.Now(), func() (resp.Object, error) {
+		return nil, errConn
+	})
+	if err != errConn {
+		t.Errorf("expected connection error, got: %#v", err)
+	}
+	if atomic.LoadInt64(&cache.StaleErrorHits) != 1 {
+		t.Errorf("expected 1 stale error hit, got: %d", atomic.LoadInt64(&cache.StaleErrorHits))
+	}
+}
+
 func BenchmarkFetchFillRate(b *testing.B) {
 	cache := NewCache()
 	var fills int
@@ -100,7 +288,7 @@ func BenchmarkFetchFillRate(b *testing.B) {
 }
 
 func TestExpire(t *testing.T) {
-	cache := NewCache()
+	cache := NewShardedCache(1)
 
 	// With no elements
 	expired := cache.Expire(-1, time.Now())
@@ -114,8 +302,7 @@ func TestExpire(t *testing.T) {
 	}
 	// a, b, and c should get expired
 	for _, letter := range []string{"a", "b", "c"} {
-		v := cache.m[letter].Value.(*cachedObject)
-		v.timestamp = time.Now().Add(-time.Hour)
+		setTimestamp(cache, letter, time.Now().Add(-time.Hour))
 	}
 
 	// Expire 2 keys
@@ -123,10 +310,10 @@ func TestExpire(t *testing.T) {
 	if expired != 2 {
 		t.Errorf("expected to expire 2 elements, got: %d", expired)
 	}
-	if _, ok := cache.m["b"]; ok {
+	if _, ok := cache.Entry("b"); ok {
 		t.Error("didn't remove b, which was old")
 	}
-	if _, ok := cache.m["c"]; !ok {
+	if _, ok := cache.Entry("c"); !ok {
 		t.Error("shouldn't remove more than 2 keys")
 	}
 
@@ -135,11 +322,201 @@ func TestExpire(t *testing.T) {
 	if expired != 4 {
 		t.Errorf("expected to expire 4 elements, got: %d", expired)
 	}
-	if _, ok := cache.m["c"]; ok {
+	if _, ok := cache.Entry("c"); ok {
 		t.Error("didn't remove c, which was old")
 	}
 }
 
+func TestMaxBytes(t *testing.T) {
+	cache := NewShardedCache(1)
+	value := resp.NewBulkString("0123456789")
+	size := len(value.Raw())
+	cache.MaxBytes = 3 * size
+
+	for _, letter := range []string{"a", "b", "c"} {
+		cache.Fetch(letter, time.Now(), func() (resp.Object, error) { return value, nil })
+	}
+	if cache.Bytes() != 3*size {
+		t.Errorf("expected %d bytes, got: %d", 3*size, cache.Bytes())
+	}
+
+	// A hit moves "a" to the front, so "b" is the least recently used
+	cache.Fetch("a", time.Now().Add(-time.Minute), func() (resp.Object, error) {
+		t.Error("Fetch called the fill function when the key was already cached")
+		return value, nil
+	})
+	cache.Fetch("d", time.Now(), func() (resp.Object, error) { return value, nil })
+	if _, ok := cache.Entry("b"); ok {
+		t.Error("didn't evict b, which was least recently used")
+	}
+	for _, letter := range []string{"a", "c", "d"} {
+		if _, ok := cache.Entry(letter); !ok {
+			t.Errorf("shouldn't have evicted %s", letter)
+		}
+	}
+	if atomic.LoadInt64(&cache.Evictions) != 1 {
+		t.Errorf("expected 1 eviction, got: %d", atomic.LoadInt64(&cache.Evictions))
+	}
+	if cache.Bytes() != 3*size {
+		t.Errorf("expected %d bytes, got: %d", 3*size, cache.Bytes())
+	}
+
+	// Refilling a key doesn't count it twice
+	cache.Fetch("a", time.Now(), func() (resp.Object, error) { return value, nil })
+	if cache.Len() != 3 || cache.Bytes() != 3*size {
+		t.Errorf("expected 3 keys and %d bytes, got: %d keys and %d bytes", 3*size, cache.Len(), cache.Bytes())
+	}
+
+	// Objects bigger than MaxBytes aren't kept
+	cache.Fetch("big", time.Now(), func() (resp.Object, error) {
+		return resp.NewBulkString(string(make([]byte, 4*size))), nil
+	})
+	if cache.Len() != 0 || cache.Bytes() != 0 {
+		t.Errorf("expected empty cache, got: %d keys and %d bytes", cache.Len(), cache.Bytes())
+	}
+	if lockCount(cache) != 0 {
+		t.Errorf("expected no key locks, got: %d", lockCount(cache))
+	}
+}
+
+func TestMaxBytes_Shards(t *testing.T) {
+	cache := NewCache()
+	value := resp.NewBulkString("0123456789")
+	size := len(value.Raw())
+	cache.MaxBytes = 10 * size
+
+	for i := 0; i < 100; i++ {
+		cache.Fetch(fmt.Sprintf("key%d", i), time.Now(), func() (resp.Object, error) { return value, nil })
+	}
+	if cache.Len() != 10 || cache.Bytes() != 10*size {
+		t.Errorf("expected 10 keys and %d bytes, got: %d keys and %d bytes", 10*size, cache.Len(), cache.Bytes())
+	}
+
+	// The least recently used keys are evicted, whichever shard they're in
+	for i := 90; i < 100; i++ {
+		if _, ok := cache.Entry(fmt.Sprintf("key%d", i)); !ok {
+			t.Errorf("shouldn't have evicted key%d", i)
+		}
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	cache := NewCache()
+	cache.MaxBytes = 1000
+	value := resp.NewBulkString("value")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				key := fmt.Sprintf("key%d", j%50)
+				switch (i + j) % 8 {
+				case 0:
+					cache.FetchStale(key, time.Now().Add(-time.Millisecond), time.Now().Add(-time.Second), func() (resp.Object, error) { return value, nil })
+				case 1:
+					cache.Tag(key, "tag")
+				case 2:
+					cache.InvalidateTag("tag")
+				case 3:
+					cache.Delete(key)
+				case 4:
+					cache.Expire(1, time.Now().Add(-time.Millisecond))
+				case 5:
+					cache.Entries("")
+				default:
+					cache.Fetch(key, time.Now().Add(-time.Millisecond), func() (resp.Object, error) { return value, nil })
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	time.Sleep(10 * time.Millisecond)
+
+	var bytes int
+	for _, entry := range cache.Entries("") {
+		bytes += entry.Size
+	}
+	if bytes != cache.Bytes() || bytes > cache.MaxBytes {
+		t.Errorf("expected %d bytes (up to %d), got: %d", bytes, cache.MaxBytes, cache.Bytes())
+	}
+	if n := lockCount(cache); n != 0 {
+		t.Errorf("expected no key locks, got: %d", n)
+	}
+}
+
+func TestTags(t *testing.T) {
+	cache := NewCache()
+	for _, letter := range []string{"a", "b", "c"} {
+		cache.Fetch(letter, time.Now(), func() (resp.Object, error) { return resp.String{}, nil })
+	}
+	cache.Tag("a", "x", "y")
+	cache.Tag("b", "x")
+	cache.Tag("nope", "x")
+
+	// Tags are kept when a value is refilled
+	cache.Fetch("a", time.Now(), func() (resp.Object, error) { return resp.String{}, nil })
+
+	if invalidated := cache.InvalidateTag("x"); invalidated != 2 {
+		t.Errorf("expected to invalidate 2 values, got: %d", invalidated)
+	}
+	if _, ok := cache.Entry("a"); ok {
+		t.Error("didn't invalidate a")
+	}
+	if _, ok := cache.Entry("c"); !ok {
+		t.Error("shouldn't have invalidated c")
+	}
+	if atomic.LoadInt64(&cache.Invalidations) != 2 {
+		t.Errorf("expected 2 invalidations, got: %d", atomic.LoadInt64(&cache.Invalidations))
+	}
+	if tagCount(cache) != 0 {
+		t.Errorf("removed values should have their tags cleaned up, got %d tags", tagCount(cache))
+	}
+
+	// Expiring a value cleans up its tags
+	cache.Tag("c", "z")
+	cache.Expire(-1, time.Now())
+	if tagCount(cache) != 0 {
+		t.Errorf("expired values should have their tags cleaned up, got %d tags", tagCount(cache))
+	}
+}
+
+func TestEntries(t *testing.T) {
+	cache := NewCache()
+	for _, letter := range []string{"a", "b", "c"} {
+		cache.Fetch(letter, time.Now(), func() (resp.Object, error) { return resp.NewBulkString(letter), nil })
+	}
+	cache.Tag("a", "x")
+	cache.Tag("c", "x")
+
+	entries := cache.Entries("x")
+	if len(entries) != 2 || entries[0].Key != "c" || entries[1].Key != "a" {
+		t.Errorf("expected entries c and a, got: %#v", entries)
+	}
+	if len(cache.Entries("")) != 3 {
+		t.Errorf("expected 3 entries, got: %#v", cache.Entries(""))
+	}
+
+	entry, ok := cache.Entry("b")
+	if !ok || entry.Size != len(resp.NewBulkString("b").Raw()) || len(entry.Tags) != 0 {
+		t.Errorf("unexpected entry: %#v", entry)
+	}
+	if _, ok := cache.Entry("nope"); ok {
+		t.Error("expected no entry for a missing key")
+	}
+
+	if deleted := cache.Delete("a", "nope"); deleted != 1 {
+		t.Errorf("expected to delete 1 value, got: %d", deleted)
+	}
+	if flushed := cache.Flush(); flushed != 2 {
+		t.Errorf("expected to flush 2 values, got: %d", flushed)
+	}
+	if cache.Len() != 0 || cache.Bytes() != 0 || tagCount(cache) != 0 {
+		t.Errorf("expected an empty cache, got %d values, %d bytes and %d tags", cache.Len(), cache.Bytes(), tagCount(cache))
+	}
+}
+
 func BenchmarkExpire(b *testing.B) {
 	cache := NewCache()
 
@@ -153,3 +530,115 @@ func BenchmarkExpire(b *testing.B) {
 	b.ResetTimer()
 	cache.Expire(-1, time.Now())
 }
+
+// BenchmarkFetchParallel measures cache hit throughput for many goroutines
+// fetching different keys. Compare GOMAXPROCS settings with -cpu 1,2,4,8.
+func BenchmarkFetchParallel(b *testing.B) {
+	benchmarkFetchParallel(b, NewCache())
+}
+
+// BenchmarkFetchParallel_OneShard is BenchmarkFetchParallel with all keys in a
+// single shard, for comparison.
+func BenchmarkFetchParallel_OneShard(b *testing.B) {
+	benchmarkFetchParallel(b, NewShardedCache(1))
+}
+
+func benchmarkFetchParallel(b *testing.B, cache *Cache) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("some_key_%d", i)
+		cache.Fetch(keys[i], time.Now(), func() (resp.Object, error) {
+			return resp.NewBulkString("some value here"), nil
+		})
+	}
+	maxAge := time.Now().Add(-time.Hour)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			cache.Fetch(keys[i%len(keys)], maxAge, func() (resp.Object, error) {
+				return resp.NewBulkString("some value here"), nil
+			})
+		}
+	})
+}
+
+func TestRefresh(t *testing.T) {
+	cache := NewCache()
+	cache.RefreshAhead = 0.5
+	cache.RefreshMinHits = 2
+	cache.RefreshColdAfter = time.Hour
+
+	var fills int64
+	fill := func() (resp.Object, error) {
+		n := atomic.AddInt64(&fills, 1)
+		return resp.NewBulkString(fmt.Sprintf("fill %d", n)), nil
+	}
+	cold := func() (resp.Object, error) { return resp.NewBulkString("cold"), nil }
+	cache.Fetch("hot", time.Now().Add(-time.Minute), fill)
+	cache.Fetch("cold", time.Now().Add(-time.Minute), cold)
+
+	// Keys aren't refreshed until they're hot and near their max age
+	if started := cache.Refresh(); started != 0 {
+		t.Errorf("expected no refreshes, got: %d", started)
+	}
+	cache.Fetch("hot", time.Now().Add(-time.Minute), fill)
+	if started := cache.Refresh(); started != 0 {
+		t.Errorf("expected no refreshes for a fresh key, got: %d", started)
+	}
+	setTimestamp(cache, "hot", time.Now().Add(-40*time.Second))
+	setTimestamp(cache, "cold", time.Now().Add(-40*time.Second))
+	if started := cache.Refresh(); started != 1 {
+		t.Errorf("expected 1 refresh, got: %d", started)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	obj, _ := cache.Fetch("hot", time.Now().Add(-time.Second), func() (resp.Object, error) {
+		t.Error("Fetch called the fill function when the key was already refreshed")
+		return nil, nil
+	})
+	if obj.(resp.String).String() != "fill 2" {
+		t.Errorf("expected the refreshed value, got: %#v", obj)
+	}
+	if n := atomic.LoadInt64(&cache.Refreshes); n != 1 {
+		t.Errorf("expected 1 refresh, got: %d", n)
+	}
+
+	// Keys that haven't been fetched recently go cold
+	cache.RefreshColdAfter = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	setTimestamp(cache, "hot", time.Now().Add(-40*time.Second))
+	if started := cache.Refresh(); started != 0 {
+		t.Errorf("expected no refreshes for a cold key, got: %d", started)
+	}
+}
+
+func TestRefresh_Concurrency(t *testing.T) {
+	cache := NewCache()
+	cache.RefreshAhead = 0.5
+	cache.RefreshMinHits = 1
+
+	release := make(chan bool)
+	defer close(release)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Fetch(key, time.Now().Add(-time.Minute), func() (resp.Object, error) {
+			select {
+			case <-release:
+			default:
+				if _, ok := cache.Entry(key); ok {
+					<-release
+				}
+			}
+			return resp.String{}, nil
+		})
+		setTimestamp(cache, key, time.Now().Add(-time.Hour))
+	}
+
+	cache.RefreshConcurrency = 2
+	if started := cache.Refresh(); started != 2 {
+		t.Errorf("expected 2 refreshes, got: %d", started)
+	}
+	if started := cache.Refresh(); started != 0 {
+		t.Errorf("expected no refreshes while all slots are busy, got: %d", started)
+	}
+}
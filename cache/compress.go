@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/stvp/resp"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+// A Codec compresses cached objects. See Cache.Codec.
+type Codec interface {
+	Compress(raw []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// FlateCodec is a Codec that uses DEFLATE (compress/flate) at the given
+// compression level. The zero value uses flate.DefaultCompression.
+type FlateCodec struct {
+	Level int
+}
+
+func (f FlateCodec) Compress(raw []byte) ([]byte, error) {
+	level := f.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f FlateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// A compressedObject is a cached object that's kept compressed with the
+// cache's Codec.
+type compressedObject struct {
+	cache *Cache
+	codec Codec
+	data  []byte
+}
+
+// compress returns the given object compressed with the Codec if it's at least
+// CompressMinBytes and compression makes it smaller, or the object itself
+// otherwise. Objects that aren't kept in memory (see objectSize) are never
+// compressed.
+func (c *Cache) compress(object resp.Object) resp.Object {
+	if c.Codec == nil {
+		return object
+	}
+	if _, ok := object.(interface {
+		Size() int
+	}); ok {
+		return object
+	}
+	raw := object.Raw()
+	if len(raw) < c.CompressMinBytes {
+		return object
+	}
+
+	start := time.Now()
+	data, err := c.Codec.Compress(raw)
+	atomic.AddInt64(&c.CompressNanos, int64(time.Since(start)))
+	if err != nil || len(data) >= len(raw) {
+		return object
+	}
+	atomic.AddInt64(&c.CompressedIn, int64(len(raw)))
+	atomic.AddInt64(&c.CompressedOut, int64(len(data)))
+	return &compressedObject{cache: c, codec: c.Codec, data: data}
+}
+
+// decompressObject decompresses the given object if it's a compressedObject.
+func (c *Cache) decompressObject(obj resp.Object) (resp.Object, error) {
+	compressed, ok := obj.(*compressedObject)
+	if !ok {
+		return obj, nil
+	}
+	raw, err := compressed.decompress()
+	if err != nil {
+		return nil, err
+	}
+	return resp.NewReaderSize(bytes.NewReader(raw), len(raw)).ReadObject()
+}
+
+func (o *compressedObject) decompress() ([]byte, error) {
+	start := time.Now()
+	raw, err := o.codec.Decompress(o.data)
+	atomic.AddInt64(&o.cache.DecompressNanos, int64(time.Since(start)))
+	return raw, err
+}
+
+// Raw decompresses the object's RESP. It returns nil if the object can't be
+// decompressed.
+func (o *compressedObject) Raw() []byte {
+	raw, err := o.decompress()
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// Size returns the compressed size of the object.
+func (o *compressedObject) Size() int {
+	return len(o.data)
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stvp/resp"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestFlateCodec(t *testing.T) {
+	codec := FlateCodec{}
+	roundTrip := func(raw []byte) bool {
+		data, err := codec.Compress(raw)
+		if err != nil {
+			return false
+		}
+		got, err := codec.Decompress(data)
+		return err == nil && bytes.Equal(got, raw)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	cache := NewCache()
+	cache.Codec = FlateCodec{}
+	cache.CompressMinBytes = 100
+
+	big := resp.NewBulkString(strings.Repeat("big reply ", 100))
+	small := resp.NewBulkString("small")
+	for _, value := range []resp.Object{big, small} {
+		key := string(value.Raw())
+		for i := 0; i < 2; i++ {
+			obj, err := cache.Fetch(key, time.Now().Add(-time.Minute), func() (resp.Object, error) {
+				return value, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(obj.Raw(), value.Raw()) {
+				t.Errorf("expected %q, got: %q", value.Raw(), obj.Raw())
+			}
+		}
+	}
+
+	obj, ok := cache.Get(string(big.Raw()), time.Now().Add(-time.Minute))
+	if !ok || !bytes.Equal(obj.Raw(), big.Raw()) {
+		t.Errorf("expected %q, got: %#v", big.Raw(), obj)
+	}
+
+	stats := cache.Stats()
+	if stats.CompressedIn != int64(len(big.Raw())) {
+		t.Errorf("expected %d compressed bytes in, got: %d", len(big.Raw()), stats.CompressedIn)
+	}
+	if stats.CompressedOut <= 0 || stats.CompressedOut >= stats.CompressedIn {
+		t.Errorf("expected fewer compressed bytes out than in, got: %d", stats.CompressedOut)
+	}
+	if stats.CompressNanos <= 0 || stats.DecompressNanos <= 0 {
+		t.Errorf("expected compression time, got: %d and %d", stats.CompressNanos, stats.DecompressNanos)
+	}
+	if expected := int(stats.CompressedOut) + len(small.Raw()); cache.Bytes() != expected {
+		t.Errorf("expected %d cached bytes, got: %d", expected, cache.Bytes())
+	}
+}
+
+type failingCodec struct{}
+
+func (failingCodec) Compress(raw []byte) ([]byte, error)    { return nil, errors.New("nope") }
+func (failingCodec) Decompress(data []byte) ([]byte, error) { return nil, errors.New("nope") }
+
+func TestCompressionError(t *testing.T) {
+	cache := NewCache()
+	cache.Codec = failingCodec{}
+	value := resp.NewBulkString(strings.Repeat("big reply ", 100))
+	cache.Set("key", value)
+
+	// Objects that can't be compressed are cached as-is
+	obj, ok := cache.Get("key", time.Now().Add(-time.Minute))
+	if !ok || !bytes.Equal(obj.Raw(), value.Raw()) {
+		t.Errorf("expected %q, got: %#v", value.Raw(), obj)
+	}
+	if stats := cache.Stats(); stats.CompressedIn != 0 {
+		t.Errorf("expected no compressed bytes, got: %d", stats.CompressedIn)
+	}
+}
@@ -0,0 +1,346 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"github.com/stvp/resp"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCompactBytes is the default DiskCache.CompactBytes.
+const DefaultCompactBytes = 64 << 20
+
+// A DiskCache is a Cache that keeps cached objects in a local file instead of
+// in memory. Only the index of keys, timestamps and tags is kept in memory,
+// which makes it a good fit for big replies that rarely change. The file is
+// truncated when the DiskCache is opened; it's not meant to survive restarts.
+//
+// Objects are appended to the file. Space used by replaced or removed objects
+// is reclaimed by rewriting the file once more than half of it, and at least
+// CompactBytes, is unused. The file is rewritten in the background while the
+// DiskCache is in use; it's only locked to swap in the new file. MaxBytes limits the size of
+// the live objects in the file.
+type DiskCache struct {
+	*Cache
+
+	CompactBytes int64
+
+	path       string
+	mutex      sync.RWMutex // guards everything below
+	file       *os.File
+	size       int64 // size of the file
+	dead       int64 // bytes in the file used by removed objects
+	refs       map[*diskObject]bool
+	compacting bool // see compactBackground
+	closed     bool
+
+	compactions sync.WaitGroup
+}
+
+// A diskObject is a cached object stored in a DiskCache's file.
+type diskObject struct {
+	cache    *DiskCache
+	offset   int64
+	size     int
+	negative bool // see Cache.IsNegative
+}
+
+// NewDiskCache creates or truncates the file at the given path and returns a
+// DiskCache that uses it.
+func NewDiskCache(path string) (*DiskCache, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d := &DiskCache{
+		Cache:        NewCache(),
+		CompactBytes: DefaultCompactBytes,
+		path:         path,
+		file:         file,
+		refs:         make(map[*diskObject]bool),
+	}
+	d.Cache.onRemove = d.release
+	return d, nil
+}
+
+// Fetch is like Cache.Fetch.
+func (d *DiskCache) Fetch(key string, maxAge time.Time, fn func() (resp.Object, error)) (resp.Object, error) {
+	return d.FetchContext(context.Background(), key, maxAge, fn)
+}
+
+// FetchContext is like Cache.FetchContext.
+func (d *DiskCache) FetchContext(ctx context.Context, key string, maxAge time.Time, fn func() (resp.Object, error)) (resp.Object, error) {
+	obj, err := d.Cache.FetchContext(ctx, key, maxAge, d.fill(fn))
+	if err != nil {
+		return obj, err
+	}
+	if obj, err = d.load(obj); err != nil {
+		// The file couldn't be read, so fill the key again
+		d.Cache.Delete(key)
+		if obj, err = d.Cache.FetchContext(ctx, key, maxAge, d.fill(fn)); err == nil {
+			obj, err = d.load(obj)
+		}
+	}
+	return obj, err
+}
+
+// FetchStale is like Cache.FetchStale.
+func (d *DiskCache) FetchStale(key string, maxAge, staleAge time.Time, fn func() (resp.Object, error)) (resp.Object, error) {
+	return d.FetchStaleContext(context.Background(), key, maxAge, staleAge, fn)
+}
+
+// FetchStaleContext is like Cache.FetchStaleContext.
+func (d *DiskCache) FetchStaleContext(ctx context.Context, key string, maxAge, staleAge time.Time, fn func() (resp.Object, error)) (resp.Object, error) {
+	obj, err := d.Cache.FetchStaleContext(ctx, key, maxAge, staleAge, d.fill(fn))
+	if err != nil {
+		return obj, err
+	}
+	if obj, err = d.load(obj); err != nil {
+		d.Cache.Delete(key)
+		return d.FetchContext(ctx, key, maxAge, fn)
+	}
+	return obj, err
+}
+
+// Get is like Cache.Get.
+func (d *DiskCache) Get(key string, maxAge time.Time) (resp.Object, bool) {
+	obj, ok := d.Cache.Get(key, maxAge)
+	if !ok {
+		return nil, false
+	}
+	obj, err := d.load(obj)
+	if err != nil {
+		d.Cache.Delete(key)
+		return nil, false
+	}
+	return obj, true
+}
+
+// Set is like Cache.Set. Objects that can't be written to the file aren't
+// cached.
+func (d *DiskCache) Set(key string, object resp.Object) {
+	object, expires, tags := unwrapFill(object)
+	ref, err := d.write(object)
+	if err == nil {
+		d.Cache.Set(key, tagged(expiring(ref, expires), tags))
+	}
+}
+
+// Close closes the DiskCache's file, after waiting for a compaction that's
+// running to stop. The DiskCache can't be used afterwards.
+func (d *DiskCache) Close() error {
+	d.mutex.Lock()
+	d.closed = true
+	d.mutex.Unlock()
+	d.compactions.Wait()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.file.Close()
+}
+
+// FileSize returns the size of the DiskCache's file, including unused space.
+func (d *DiskCache) FileSize() int64 {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.size
+}
+
+// fill wraps the given cache fill function so that filled objects are written
+// to the file.
+func (d *DiskCache) fill(fn func() (resp.Object, error)) func() (resp.Object, error) {
+	return func() (resp.Object, error) {
+		obj, err := fn()
+		if err != nil {
+			return obj, err
+		}
+		obj, expires, tags := unwrapFill(obj)
+		ref, err := d.write(obj)
+		if err != nil {
+			return nil, err
+		}
+		return tagged(expiring(ref, expires), tags), nil
+	}
+}
+
+// load reads the given object from the file if it's a diskObject.
+func (d *DiskCache) load(obj resp.Object) (resp.Object, error) {
+	ref, ok := obj.(*diskObject)
+	if !ok {
+		return obj, nil
+	}
+	raw, err := d.read(ref)
+	if err != nil {
+		return nil, err
+	}
+	return resp.NewReaderSize(bytes.NewReader(raw), len(raw)).ReadObject()
+}
+
+func (d *DiskCache) write(obj resp.Object) (*diskObject, error) {
+	raw := obj.Raw()
+	negative := d.IsNegative != nil && d.IsNegative(obj)
+
+	d.mutex.Lock()
+	if _, err := d.file.WriteAt(raw, d.size); err != nil {
+		d.mutex.Unlock()
+		return nil, err
+	}
+	ref := &diskObject{cache: d, offset: d.size, size: len(raw), negative: negative}
+	d.size += int64(len(raw))
+	d.refs[ref] = true
+	d.startCompaction()
+	d.mutex.Unlock()
+	return ref, nil
+}
+
+// needsCompaction returns true if more than half of the file, and at least
+// CompactBytes, is unused. The mutex must be held.
+func (d *DiskCache) needsCompaction() bool {
+	return d.dead >= d.CompactBytes && d.dead > d.size/2
+}
+
+// startCompaction compacts the file in the background if it needs it and
+// isn't already being compacted. The mutex must be held.
+func (d *DiskCache) startCompaction() {
+	if !d.compacting && !d.closed && d.needsCompaction() {
+		d.compacting = true
+		d.compactions.Add(1)
+		go d.compactBackground()
+	}
+}
+
+// compactBackground compacts the file until it no longer needs it, and then
+// clears compacting, which is set so that only one compaction runs at a time.
+// A failed compaction leaves the old file in place.
+func (d *DiskCache) compactBackground() {
+	defer d.compactions.Done()
+	for {
+		err := d.compact()
+		d.mutex.Lock()
+		if err != nil || d.closed || !d.needsCompaction() {
+			d.compacting = false
+			d.mutex.Unlock()
+			return
+		}
+		d.mutex.Unlock()
+	}
+}
+
+func (d *DiskCache) read(ref *diskObject) ([]byte, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	raw := make([]byte, ref.size)
+	_, err := d.file.ReadAt(raw, ref.offset)
+	return raw, err
+}
+
+// release marks the space used by a removed object as unused.
+func (d *DiskCache) release(obj resp.Object) {
+	ref, ok := obj.(*diskObject)
+	if !ok {
+		return
+	}
+	d.mutex.Lock()
+	if d.refs[ref] {
+		delete(d.refs, ref)
+		d.dead += int64(ref.size)
+		d.startCompaction()
+	}
+	d.mutex.Unlock()
+}
+
+// compact copies the live objects to a new file and replaces the old file
+// with it. The objects are copied with the mutex unlocked, so the DiskCache
+// can be used in the meantime; it's only locked to copy the objects written
+// during the copy and to swap in the new file. See compactBackground.
+func (d *DiskCache) compact() error {
+	d.mutex.RLock()
+	file := d.file
+	refs := make([]*diskObject, 0, len(d.refs))
+	for ref := range d.refs {
+		refs = append(refs, ref)
+	}
+	d.mutex.RUnlock()
+
+	offsets := make(map[*diskObject]int64, len(refs))
+	tmp, err := os.OpenFile(d.path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	var size int64
+	if err == nil {
+		size, err = copyObjects(file, tmp, refs, offsets, 0)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if tmp == nil {
+		return err
+	}
+	if err == nil && d.closed {
+		err = os.ErrClosed
+	}
+	if err == nil {
+		var added []*diskObject
+		for ref := range d.refs {
+			if _, ok := offsets[ref]; !ok {
+				added = append(added, ref)
+			}
+		}
+		size, err = copyObjects(d.file, tmp, added, offsets, size)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	d.file.Close()
+	d.file = tmp
+	d.size = size
+	d.dead = 0
+	for ref, offset := range offsets {
+		ref.offset = offset
+		if !d.refs[ref] {
+			// Removed during the copy
+			d.dead += int64(ref.size)
+		}
+	}
+	return nil
+}
+
+// copyObjects copies the given objects from one file to the end of another,
+// which is the given size, and records their offsets in the new file. It
+// returns the new file's size.
+func copyObjects(from, to *os.File, refs []*diskObject, offsets map[*diskObject]int64, size int64) (int64, error) {
+	for _, ref := range refs {
+		raw := make([]byte, ref.size)
+		if _, err := from.ReadAt(raw, ref.offset); err != nil {
+			return size, err
+		}
+		if _, err := to.WriteAt(raw, size); err != nil {
+			return size, err
+		}
+		offsets[ref] = size
+		size += int64(ref.size)
+	}
+	return size, nil
+}
+
+// Raw reads the object's RESP from the file. It returns nil if the file can't
+// be read.
+func (o *diskObject) Raw() []byte {
+	raw, err := o.cache.read(o)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// Size returns the size of the object's RESP without reading it.
+func (o *diskObject) Size() int {
+	return o.size
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stvp/resp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	_ Store = &Cache{}
+	_ Store = &DiskCache{}
+)
+
+func withDiskCache(fn func(*DiskCache)) {
+	dir, err := ioutil.TempDir("", "aorta")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := NewDiskCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		panic(err)
+	}
+	defer cache.Close()
+	fn(cache)
+}
+
+func TestDiskCacheFetch(t *testing.T) {
+	withDiskCache(func(cache *DiskCache) {
+		value := resp.NewBulkString("cool")
+		for i := 0; i < 2; i++ {
+			obj, err := cache.Fetch("mykey", time.Now().Add(-time.Minute), func() (resp.Object, error) {
+				if i > 0 {
+					t.Error("Fetch called the fill function when the key was already cached")
+				}
+				return value, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.(resp.String).String() != "cool" {
+				t.Errorf("Fetch() returned the wrong object: %#v", obj)
+			}
+		}
+		if cache.Bytes() != len(value.Raw()) || cache.FileSize() != int64(len(value.Raw())) {
+			t.Errorf("expected %d bytes, got %d bytes and a %d byte file", len(value.Raw()), cache.Bytes(), cache.FileSize())
+		}
+
+		// Objects are only kept in the file
+		s := cache.shard("mykey")
+		s.Lock()
+		_, onDisk := s.m["mykey"].Value.(*cachedObject).object.(*diskObject)
+		s.Unlock()
+		if !onDisk {
+			t.Error("expected the cached object to be kept on disk")
+		}
+
+		// Errors aren't cached
+		_, err := cache.Fetch("badkey", time.Now(), func() (resp.Object, error) {
+			return nil, fmt.Errorf("oh no")
+		})
+		if err == nil || cache.Len() != 1 {
+			t.Errorf("expected an error and 1 key, got: %#v and %d keys", err, cache.Len())
+		}
+	})
+}
+
+func TestDiskCacheCompact(t *testing.T) {
+	withDiskCache(func(cache *DiskCache) {
+		cache.CompactBytes = 100
+		value := resp.NewBulkString("0123456789")
+		size := int64(len(value.Raw()))
+
+		for i := 0; i < 20; i++ {
+			cache.Fetch(fmt.Sprintf("key%d", i%2), time.Now(), func() (resp.Object, error) {
+				return resp.NewBulkString(fmt.Sprintf("012345678%d", i%10)), nil
+			})
+		}
+		// Compaction runs in the background
+		cache.compactions.Wait()
+		if cache.FileSize() > 12*size {
+			t.Errorf("expected the file to be compacted, got %d bytes", cache.FileSize())
+		}
+
+		for i, expected := range []string{"0123456788", "0123456789"} {
+			obj, _ := cache.Fetch(fmt.Sprintf("key%d", i), time.Now().Add(-time.Minute), func() (resp.Object, error) {
+				t.Error("Fetch called the fill function when the key was already cached")
+				return nil, nil
+			})
+			if obj.(resp.String).String() != expected {
+				t.Errorf("expected %#v after compaction, got: %#v", expected, obj)
+			}
+		}
+
+		if flushed := cache.Flush(); flushed != 2 {
+			t.Errorf("expected to flush 2 values, got: %d", flushed)
+		}
+		if cache.Bytes() != 0 {
+			t.Errorf("expected 0 bytes, got: %d", cache.Bytes())
+		}
+	})
+}
+
+func TestDiskCacheConcurrent(t *testing.T) {
+	withDiskCache(func(cache *DiskCache) {
+		cache.CompactBytes = 1000
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					key := fmt.Sprintf("key%d", j%20)
+					obj, err := cache.FetchStale(key, time.Now().Add(-time.Millisecond), time.Now().Add(-time.Second), func() (resp.Object, error) {
+						return resp.NewBulkString(key), nil
+					})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if obj.(resp.String).String() != key {
+						t.Errorf("expected %#v, got: %#v", key, obj)
+						return
+					}
+					if j%50 == 0 {
+						cache.Delete(key)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+func TestDiskCacheCompact_Concurrent(t *testing.T) {
+	withDiskCache(func(cache *DiskCache) {
+		// Compact as often as possible while objects are written and read
+		cache.CompactBytes = 1
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					key := fmt.Sprintf("key%d", i)
+					value := fmt.Sprintf("%d-%d", i, j)
+					cache.Set(key, resp.NewBulkString(value))
+					obj, ok := cache.Get(key, time.Now().Add(-time.Minute))
+					if !ok || obj.(resp.String).String() != value {
+						t.Errorf("expected %#v, got: %#v", value, obj)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		cache.compactions.Wait()
+		if size, live := cache.FileSize(), int64(cache.Bytes()); size > 2*live+int64(cache.CompactBytes) {
+			t.Errorf("expected the file to be compacted, got %d bytes for %d live bytes", size, live)
+		}
+	})
+}
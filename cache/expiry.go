@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"github.com/stvp/resp"
+	"time"
+)
+
+// An ExpiringObject is a resp.Object that mustn't be cached past the given
+// time, e.g. the value of a Redis key with a TTL. Cache fill functions can
+// return one to limit how long the object is cached; it's removed from the
+// cache when it expires, regardless of the max age it's fetched with. The
+// Cache returns the wrapped object itself.
+type ExpiringObject struct {
+	resp.Object
+	Expires time.Time
+}
+
+// unwrapExpiring returns the object wrapped by the given ExpiringObject and
+// its expiry time, or the given object and a zero time if it isn't one.
+func unwrapExpiring(object resp.Object) (resp.Object, time.Time) {
+	if e, ok := object.(ExpiringObject); ok {
+		return e.Object, e.Expires
+	}
+	return object, time.Time{}
+}
+
+// expiring wraps the given object in an ExpiringObject if the expiry time
+// isn't zero.
+func expiring(object resp.Object, expires time.Time) resp.Object {
+	if expires.IsZero() {
+		return object
+	}
+	return ExpiringObject{object, expires}
+}
+
+// expired returns true if the value has an expiry time that's passed.
+func (v *cachedObject) expired(now time.Time) bool {
+	return !v.expires.IsZero() && !now.Before(v.expires)
+}
+
+// expireLater removes the given value from the cache once it expires. The
+// shard must be locked.
+func (c *Cache) expireLater(s *shard, value *cachedObject) {
+	if value.expires.IsZero() {
+		return
+	}
+	value.timer = time.AfterFunc(time.Until(value.expires), func() {
+		s.Lock()
+		if element, ok := s.m[value.key]; ok && element.Value == value {
+			c.unlink(s, element)
+		}
+		s.Unlock()
+	})
+}
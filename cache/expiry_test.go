@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"github.com/stvp/resp"
+	"testing"
+	"time"
+)
+
+func TestExpiringObject(t *testing.T) {
+	cache := NewCache()
+	value := resp.NewBulkString("value")
+	fills := 0
+	fill := func() (resp.Object, error) {
+		fills++
+		return ExpiringObject{value, time.Now().Add(50 * time.Millisecond)}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		obj, err := cache.Fetch("key", time.Now().Add(-time.Minute), fill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := obj.(ExpiringObject); ok {
+			t.Errorf("expected the wrapped object, got: %#v", obj)
+		}
+		if string(obj.Raw()) != string(value.Raw()) {
+			t.Errorf("expected %q, got: %q", value.Raw(), obj.Raw())
+		}
+	}
+	if fills != 1 {
+		t.Errorf("expected 1 fill, got: %d", fills)
+	}
+	entry, ok := cache.Entry("key")
+	if !ok || entry.Expires.IsZero() {
+		t.Errorf("expected an expiry time, got: %#v", entry)
+	}
+
+	// The value is removed once it expires, even though it's within max age
+	time.Sleep(100 * time.Millisecond)
+	if n := cache.Len(); n != 0 {
+		t.Errorf("expected the expired value to be removed, got %d keys", n)
+	}
+	if _, ok := cache.Get("key", time.Now().Add(-time.Minute)); ok {
+		t.Error("expected a miss for the expired value")
+	}
+	cache.Fetch("key", time.Now().Add(-time.Minute), fill)
+	if fills != 2 {
+		t.Errorf("expected 2 fills, got: %d", fills)
+	}
+}
+
+func TestExpiringObject_Expired(t *testing.T) {
+	cache := NewCache()
+	cache.Set("key", ExpiringObject{resp.NewBulkString("value"), time.Now().Add(-time.Second)})
+	if _, ok := cache.Get("key", time.Now().Add(-time.Minute)); ok {
+		t.Error("expected a miss for an already expired value")
+	}
+	if _, err := cache.FetchStale("key", time.Now(), time.Now().Add(-time.Minute), func() (resp.Object, error) {
+		return resp.NewBulkString("fresh"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := cache.Entry("key"); !ok || !entry.Expires.IsZero() {
+		t.Errorf("expected the fresh value without an expiry time, got: %#v", entry)
+	}
+}
@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"github.com/stvp/resp"
+	"time"
+)
+
+// isNegative returns whether the given object is a negative result according
+// to IsNegative. Objects in a DiskCache's file are checked when they're
+// written, so that they don't need to be read back.
+func (c *Cache) isNegative(object resp.Object) bool {
+	if c.IsNegative == nil {
+		return false
+	}
+	if ref, ok := object.(*diskObject); ok {
+		return ref.negative
+	}
+	return c.IsNegative(object)
+}
+
+// maxAge returns the max age to use for the given value: the given max age, or
+// NegativeMaxAge ago for negative values if that's more recent.
+func (c *Cache) maxAge(value *cachedObject, maxAge time.Time) time.Time {
+	if !value.negative {
+		return maxAge
+	}
+	if limit := time.Now().Add(-c.NegativeMaxAge); limit.After(maxAge) {
+		return limit
+	}
+	return maxAge
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"github.com/stvp/resp"
+	"testing"
+	"time"
+)
+
+func isNil(obj resp.Object) bool {
+	return string(obj.Raw()) == "$-1\r\n"
+}
+
+func TestNegative(t *testing.T) {
+	cache := NewCache()
+	cache.IsNegative = isNil
+	cache.NegativeMaxAge = 50 * time.Millisecond
+	missing := resp.String("$-1\r\n")
+	value := resp.NewBulkString("value")
+
+	fills := 0
+	for _, key := range []string{"missing", "value"} {
+		for i := 0; i < 2; i++ {
+			cache.Fetch(key, time.Now().Add(-time.Minute), func() (resp.Object, error) {
+				fills++
+				if key == "missing" {
+					return missing, nil
+				}
+				return value, nil
+			})
+		}
+	}
+	if fills != 2 {
+		t.Errorf("expected 2 fills, got: %d", fills)
+	}
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.NegativeHits != 1 {
+		t.Errorf("expected 1 hit and 1 negative hit, got: %d and %d", stats.Hits, stats.NegativeHits)
+	}
+
+	// Negative values expire sooner than the max age
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := cache.Get("missing", time.Now().Add(-time.Minute)); ok {
+		t.Error("expected a miss for an old negative value")
+	}
+	if _, ok := cache.Get("value", time.Now().Add(-time.Minute)); !ok {
+		t.Error("expected a hit for a value within max age")
+	}
+
+	// A shorter max age still applies
+	cache.Set("missing", missing)
+	if _, ok := cache.Get("missing", time.Now()); ok {
+		t.Error("expected a miss for a negative value older than max age")
+	}
+}
+
+func TestNegative_Disk(t *testing.T) {
+	withDiskCache(func(cache *DiskCache) {
+		cache.IsNegative = isNil
+		cache.Set("missing", resp.String("$-1\r\n"))
+		if _, ok := cache.Get("missing", time.Now().Add(-time.Minute)); ok {
+			t.Error("expected a miss for a negative value with no NegativeMaxAge")
+		}
+		if n := cache.Stats().NegativeHits; n != 0 {
+			t.Errorf("expected no negative hits, got: %d", n)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"github.com/stvp/resp"
+	"sync/atomic"
+	"time"
+)
+
+// Refresh starts background refreshes for hot keys that are nearly as old as
+// the max age they were last fetched with, and returns the number of
+// refreshes started. It should be called regularly, e.g. every 100ms.
+//
+// A key is hot once it has been fetched RefreshMinHits times. It's refreshed
+// once its age is within RefreshAhead of the max age it was last fetched with,
+// as a fraction: 0.1 refreshes a key fetched with a 60 second max age once
+// it's 54 seconds old. Refreshes call the fill function from the key's most
+// recent fetch. Keys that haven't been fetched for RefreshColdAfter are no
+// longer hot. At most RefreshConcurrency refreshes run at a time (one if it's
+// not set); keys that don't get a refresh slot are tried again on the next
+// call. Refresh errors are counted in RevalidateErrors.
+func (c *Cache) Refresh() (started int) {
+	if c.RefreshAhead <= 0 {
+		return 0
+	}
+	c.refreshOnce.Do(func() {
+		concurrency := c.RefreshConcurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		c.refreshSlots = make(chan bool, concurrency)
+	})
+
+	now := time.Now()
+	for _, s := range c.shards {
+		s.Lock()
+		for key, obj := range s.hot {
+			if c.RefreshColdAfter > 0 && now.Sub(obj.fetched) > c.RefreshColdAfter {
+				delete(s.hot, key)
+				obj.fetches = 0
+				continue
+			}
+			refreshAt := obj.timestamp.Add(time.Duration(float64(obj.fetchAge) * (1 - c.RefreshAhead)))
+			if obj.revalidating || now.Before(refreshAt) {
+				continue
+			}
+
+			select {
+			case c.refreshSlots <- true:
+			default:
+				s.Unlock()
+				return started
+			}
+			obj.revalidating = true
+			started++
+			go func(key string, obj *cachedObject, fn func() (resp.Object, error)) {
+				defer func() { <-c.refreshSlots }()
+				c.revalidate(key, obj, fn)
+			}(key, obj, obj.refreshFn)
+		}
+		s.Unlock()
+	}
+	atomic.AddInt64(&c.Refreshes, int64(started))
+	return started
+}
+
+// noteFetch records a fetch of the given object for refresh-ahead. The shard
+// must be locked.
+func (c *Cache) noteFetch(s *shard, obj *cachedObject, maxAge time.Time, fn func() (resp.Object, error)) {
+	if c.RefreshAhead <= 0 || fn == nil {
+		return
+	}
+	obj.fetches++
+	obj.fetched = time.Now()
+	obj.fetchAge = obj.fetched.Sub(maxAge)
+	obj.refreshFn = fn
+
+	// The object may have been evicted since it was stored
+	if element, ok := s.m[obj.key]; !ok || element.Value != obj {
+		return
+	}
+	if obj.fetches >= c.RefreshMinHits {
+		s.hot[obj.key] = obj
+	}
+}
+
+// keepRefresh copies the refresh-ahead state of the given object that's being
+// replaced. The shard must be locked.
+func (v *cachedObject) keepRefresh(s *shard, old *cachedObject) {
+	v.fetches = old.fetches
+	v.fetched = old.fetched
+	v.fetchAge = old.fetchAge
+	v.refreshFn = old.refreshFn
+	if s.hot[old.key] == old {
+		s.hot[old.key] = v
+	}
+}
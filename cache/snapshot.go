@@ -0,0 +1,368 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"github.com/stvp/resp"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshots start with snapshotMagic and the format version, followed by one
+// record per cached value, oldest first, and an end record with the number of
+// values. Each value record is:
+//
+//	recordValue
+//	key        (uvarint length + bytes)
+//	timestamp  (varint Unix nanoseconds)
+//	expires    (varint Unix nanoseconds, or 0 if the value doesn't expire)
+//	tags       (uvarint count, then uvarint length + bytes for each)
+//	object     (uvarint length + raw RESP)
+//	checksum   (CRC-32 of the record, big-endian uint32)
+const (
+	snapshotMagic   = "AORTACACHE"
+	snapshotVersion = 2
+
+	recordEnd   = 0
+	recordValue = 1
+)
+
+var (
+	ErrSnapshotVersion = errors.New("aorta: unsupported cache snapshot version")
+	ErrSnapshotCorrupt = errors.New("aorta: corrupt cache snapshot")
+)
+
+type snapshotValue struct {
+	key       string
+	timestamp time.Time
+	expires   time.Time
+	tags      []string
+	raw       []byte
+}
+
+// SaveSnapshot writes all cached values to the file at the given path. The
+// snapshot is written to a temporary file in the same directory first and then
+// renamed, so the file at path is always a complete snapshot.
+func (c *Cache) SaveSnapshot(path string) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	if _, err = c.WriteSnapshot(w); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot adds the values in the snapshot file at the given path to the
+// cache and returns the number of values added. A missing file isn't an error.
+// See ReadSnapshot.
+func (c *Cache) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.ReadSnapshot(bufio.NewReader(f))
+}
+
+// WriteSnapshot writes all cached values, with their timestamps and tags, to
+// the given io.Writer and returns the number of values written.
+func (c *Cache) WriteSnapshot(w io.Writer) (int, error) {
+	var values []snapshotValue
+	var objects []resp.Object
+	for _, s := range c.shards {
+		s.Lock()
+		for e := s.l.Front(); e != nil; e = e.Next() {
+			value := e.Value.(*cachedObject)
+			values = append(values, snapshotValue{
+				key:       value.key,
+				timestamp: value.timestamp,
+				expires:   value.expires,
+				tags:      append([]string(nil), value.tags...),
+			})
+			objects = append(objects, value.object)
+		}
+		s.Unlock()
+	}
+
+	// Objects may need to be read from disk, so get their RESP without any
+	// shards locked
+	for i, object := range objects {
+		values[i].raw = object.Raw()
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].timestamp.Before(values[j].timestamp)
+	})
+
+	var header bytes.Buffer
+	header.WriteString(snapshotMagic)
+	binary.Write(&header, binary.BigEndian, uint32(snapshotVersion))
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return 0, err
+	}
+
+	var record bytes.Buffer
+	for _, value := range values {
+		record.Reset()
+		record.WriteByte(recordValue)
+		writeBytes(&record, []byte(value.key))
+		writeVarint(&record, value.timestamp.UnixNano())
+		var expires int64
+		if !value.expires.IsZero() {
+			expires = value.expires.UnixNano()
+		}
+		writeVarint(&record, expires)
+		writeUvarint(&record, uint64(len(value.tags)))
+		for _, tag := range value.tags {
+			writeBytes(&record, []byte(tag))
+		}
+		writeBytes(&record, value.raw)
+		binary.Write(&record, binary.BigEndian, crc32.ChecksumIEEE(record.Bytes()))
+		if _, err := w.Write(record.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+
+	record.Reset()
+	record.WriteByte(recordEnd)
+	writeUvarint(&record, uint64(len(values)))
+	if _, err := w.Write(record.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(values), nil
+}
+
+// ReadSnapshot adds the values in the snapshot from the given io.Reader to the
+// cache, keeping their original timestamps and tags, and returns the number of
+// values added. Values that are already cached with a newer timestamp or that
+// have expired are skipped. The whole snapshot is read and checked before any
+// values are added, so if it has a different format version or is corrupt
+// (e.g. truncated), nothing is added and ErrSnapshotVersion or
+// ErrSnapshotCorrupt is returned.
+func (c *Cache) ReadSnapshot(r io.Reader) (int, error) {
+	values, err := readSnapshot(bufio.NewReader(r))
+	if err != nil {
+		return 0, err
+	}
+
+	objects := make([]resp.Object, len(values))
+	for i, value := range values {
+		objects[i], err = resp.NewReaderSize(bytes.NewReader(value.raw), len(value.raw)).ReadObject()
+		if err != nil {
+			return 0, ErrSnapshotCorrupt
+		}
+	}
+
+	var added int
+	for i, value := range values {
+		if c.restore(value, c.compress(objects[i])) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+func readSnapshot(r *bufio.Reader) ([]snapshotValue, error) {
+	header := make([]byte, len(snapshotMagic)+4)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, ErrSnapshotCorrupt
+	}
+	if binary.BigEndian.Uint32(header[len(snapshotMagic):]) != snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+
+	var values []snapshotValue
+	for {
+		// Keep a copy of the record's bytes to check its checksum
+		var record bytes.Buffer
+		tr := &teeByteReader{r, &record}
+
+		kind, err := tr.ReadByte()
+		if err != nil {
+			return nil, ErrSnapshotCorrupt
+		}
+		if kind == recordEnd {
+			count, err := binary.ReadUvarint(tr)
+			if err != nil || count != uint64(len(values)) {
+				return nil, ErrSnapshotCorrupt
+			}
+			return values, nil
+		}
+		if kind != recordValue {
+			return nil, ErrSnapshotCorrupt
+		}
+
+		var value snapshotValue
+		key, err := readBytes(tr)
+		if err != nil {
+			return nil, ErrSnapshotCorrupt
+		}
+		value.key = string(key)
+		nanos, err := binary.ReadVarint(tr)
+		if err != nil {
+			return nil, ErrSnapshotCorrupt
+		}
+		value.timestamp = time.Unix(0, nanos)
+		if nanos, err = binary.ReadVarint(tr); err != nil {
+			return nil, ErrSnapshotCorrupt
+		}
+		if nanos != 0 {
+			value.expires = time.Unix(0, nanos)
+		}
+		tagCount, err := binary.ReadUvarint(tr)
+		if err != nil {
+			return nil, ErrSnapshotCorrupt
+		}
+		for i := uint64(0); i < tagCount; i++ {
+			tag, err := readBytes(tr)
+			if err != nil {
+				return nil, ErrSnapshotCorrupt
+			}
+			value.tags = append(value.tags, string(tag))
+		}
+		if value.raw, err = readBytes(tr); err != nil {
+			return nil, ErrSnapshotCorrupt
+		}
+
+		sum := crc32.ChecksumIEEE(record.Bytes())
+		var expected uint32
+		if err := binary.Read(r, binary.BigEndian, &expected); err != nil || sum != expected {
+			return nil, ErrSnapshotCorrupt
+		}
+		values = append(values, value)
+	}
+}
+
+// restore adds a value from a snapshot to the cache unless the key is already
+// cached with a newer value or the value has expired. The lists are kept in
+// order by inserting the value after any newer values.
+func (c *Cache) restore(value snapshotValue, object resp.Object) bool {
+	if !value.expires.IsZero() && !time.Now().Before(value.expires) {
+		return false
+	}
+	s := c.shard(value.key)
+	s.Lock()
+	if element, ok := s.m[value.key]; ok {
+		if !element.Value.(*cachedObject).timestamp.Before(value.timestamp) {
+			s.Unlock()
+			return false
+		}
+		c.unlink(s, element)
+	}
+
+	obj := &cachedObject{
+		key:       value.key,
+		object:    object,
+		timestamp: value.timestamp,
+		used:      value.timestamp,
+		size:      objectSize(object),
+		expires:   value.expires,
+		negative:  c.isNegative(object),
+	}
+	s.m[value.key] = insertOrdered(&s.l, obj, func(v *cachedObject) bool { return v.timestamp.After(obj.timestamp) })
+	obj.lruElement = insertOrdered(&s.lru, obj, func(v *cachedObject) bool { return v.used.After(obj.used) })
+	s.addTags(obj, value.tags)
+	c.expireLater(s, obj)
+	s.Unlock()
+
+	atomic.AddInt64(&c.bytes, int64(obj.size))
+	c.evict()
+	return true
+}
+
+// insertOrdered inserts the given object into the list after the elements at
+// the front for which newer returns true.
+func insertOrdered(l *list.List, obj *cachedObject, newer func(*cachedObject) bool) *list.Element {
+	e := l.Front()
+	for e != nil && newer(e.Value.(*cachedObject)) {
+		e = e.Next()
+	}
+	if e == nil {
+		return l.PushBack(obj)
+	}
+	return l.InsertBefore(obj, e)
+}
+
+// -- Encoding helpers
+
+func writeUvarint(buf *bytes.Buffer, n uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutUvarint(b, n)])
+}
+
+func writeVarint(buf *bytes.Buffer, n int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutVarint(b, n)])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+// maxSnapshotField limits the length of a single field so that a corrupt
+// length doesn't cause a huge allocation.
+const maxSnapshotField = 512 << 20
+
+func readBytes(r *teeByteReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSnapshotField {
+		return nil, ErrSnapshotCorrupt
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// A teeByteReader copies everything read from r to w.
+type teeByteReader struct {
+	r *bufio.Reader
+	w *bytes.Buffer
+}
+
+func (t *teeByteReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.w.Write(p[:n])
+	return n, err
+}
+
+func (t *teeByteReader) ReadByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.w.WriteByte(b)
+	}
+	return b, err
+}
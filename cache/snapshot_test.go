@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"bytes"
+	"github.com/stvp/resp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	cache := NewCache()
+	for _, letter := range []string{"a", "b", "c"} {
+		cache.Fetch(letter, time.Now(), func() (resp.Object, error) { return resp.NewBulkString(letter), nil })
+	}
+	cache.Tag("a", "x", "y")
+	setTimestamp(cache, "a", time.Now().Add(-time.Minute))
+	cache.Set("c", ExpiringObject{resp.NewBulkString("c"), time.Now().Add(time.Hour)})
+
+	var buf bytes.Buffer
+	written, err := cache.WriteSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 3 {
+		t.Errorf("expected to write 3 values, got: %d", written)
+	}
+
+	restored := NewCache()
+	loaded, err := restored.ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 3 {
+		t.Errorf("expected to load 3 values, got: %d", loaded)
+	}
+	expected := cache.Entries("")
+	for i := range expected {
+		// Snapshots don't keep monotonic clock readings
+		expected[i].Timestamp = expected[i].Timestamp.Round(0)
+		expected[i].Expires = expected[i].Expires.Round(0)
+	}
+	if !reflect.DeepEqual(expected, restored.Entries("")) {
+		t.Errorf("expected entries %#v, got: %#v", expected, restored.Entries(""))
+	}
+	if restored.Bytes() != cache.Bytes() {
+		t.Errorf("expected %d bytes, got: %d", cache.Bytes(), restored.Bytes())
+	}
+
+	// Timestamps are kept, so stale values are still stale
+	obj, _ := restored.Fetch("b", time.Now().Add(-time.Second), func() (resp.Object, error) {
+		t.Error("Fetch called the fill function for a restored value")
+		return nil, nil
+	})
+	if obj.(resp.String).String() != "b" {
+		t.Errorf("Fetch() returned the wrong object: %#v", obj)
+	}
+	obj, _ = restored.Fetch("a", time.Now().Add(-time.Second), func() (resp.Object, error) {
+		return resp.NewBulkString("new a"), nil
+	})
+	if obj.(resp.String).String() != "new a" {
+		t.Errorf("Fetch() returned a stale restored object: %#v", obj)
+	}
+
+	// Newer values aren't replaced
+	restored.Delete("b")
+	loaded, _ = restored.ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	if loaded != 1 {
+		t.Errorf("expected to only load the missing value, got: %d", loaded)
+	}
+}
+
+func TestSnapshot_Expired(t *testing.T) {
+	cache := NewCache()
+	cache.Set("a", ExpiringObject{resp.NewBulkString("a"), time.Now().Add(50 * time.Millisecond)})
+	cache.Set("b", resp.NewBulkString("b"))
+
+	var buf bytes.Buffer
+	if _, err := cache.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Values that have expired since the snapshot was taken aren't loaded
+	restored := NewCache()
+	loaded, err := restored.ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 1 {
+		t.Errorf("expected to load 1 value, got: %d", loaded)
+	}
+	if _, ok := restored.Entry("a"); ok {
+		t.Error("expected the expired value not to be loaded")
+	}
+}
+
+func TestSnapshot_Invalid(t *testing.T) {
+	cache := NewCache()
+	cache.Fetch("a", time.Now(), func() (resp.Object, error) { return resp.NewBulkString("a"), nil })
+	var buf bytes.Buffer
+	cache.WriteSnapshot(&buf)
+	snapshot := buf.Bytes()
+
+	flipped := append([]byte(nil), snapshot...)
+	flipped[len(flipped)-8] ^= 0xff
+	version := append([]byte(nil), snapshot...)
+	version[len(snapshotMagic)+3] = snapshotVersion + 1
+
+	// A record with a valid checksum but invalid RESP, after a valid record
+	cache.Set("b", resp.String("not RESP"))
+	buf.Reset()
+	cache.WriteSnapshot(&buf)
+	badObject := buf.Bytes()
+
+	tests := []struct {
+		snapshot []byte
+		err      error
+	}{
+		{nil, ErrSnapshotCorrupt},
+		{[]byte("nope"), ErrSnapshotCorrupt},
+		{snapshot[:len(snapshot)-1], ErrSnapshotCorrupt},
+		{snapshot[:len(snapshot)-4], ErrSnapshotCorrupt},
+		{flipped, ErrSnapshotCorrupt},
+		{version, ErrSnapshotVersion},
+		{badObject, ErrSnapshotCorrupt},
+	}
+	for i, test := range tests {
+		restored := NewCache()
+		loaded, err := restored.ReadSnapshot(bytes.NewReader(test.snapshot))
+		if err != test.err {
+			t.Errorf("tests[%d]: expected %#v, got: %#v", i, test.err, err)
+		}
+		if loaded != 0 || restored.Len() != 0 {
+			t.Errorf("tests[%d]: expected nothing to be loaded, got: %d", i, restored.Len())
+		}
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aorta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snapshot")
+
+	// Missing files are ignored
+	cache := NewCache()
+	if loaded, err := cache.LoadSnapshot(path); loaded != 0 || err != nil {
+		t.Errorf("expected nothing loaded and no error, got: %d, %#v", loaded, err)
+	}
+
+	cache.Fetch("a", time.Now(), func() (resp.Object, error) { return resp.NewBulkString("a"), nil })
+	for i := 0; i < 2; i++ {
+		if err := cache.SaveSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected only the snapshot file, got %d files", len(files))
+	}
+
+	restored := NewCache()
+	if loaded, err := restored.LoadSnapshot(path); loaded != 1 || err != nil {
+		t.Errorf("expected 1 value loaded, got: %d, %#v", loaded, err)
+	}
+}
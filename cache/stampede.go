@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/stvp/resp"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrWaitTimeout is returned by Fetch when it gives up waiting for a
+	// simultaneous cache fill of the same key. See Cache.MaxWait.
+	ErrWaitTimeout = errors.New("aorta: timed out waiting for cache fill")
+
+	// ErrFillTimeout is returned by Fetch when a cache fill takes too long.
+	// See Cache.FillTimeout.
+	ErrFillTimeout = errors.New("aorta: cache fill timed out")
+)
+
+// lockKeyWait locks the given key like lockKeyContext, but gives up with
+// ErrWaitTimeout if the key is still locked by another cache fill after
+// MaxWait.
+func (c *Cache) lockKeyWait(ctx context.Context, s *shard, key string) (*keyLock, error) {
+	if c.MaxWait <= 0 {
+		return s.lockKeyContext(ctx, key)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, c.MaxWait)
+	defer cancel()
+	lock, err := s.lockKeyContext(waitCtx, key)
+	if err != nil && ctx.Err() == nil {
+		atomic.AddInt64(&c.WaitTimeouts, 1)
+		return nil, ErrWaitTimeout
+	}
+	return lock, err
+}
+
+type fillResult struct {
+	object resp.Object
+	err    error
+}
+
+// callFill calls the given cache fill function, giving up with ErrFillTimeout
+// after FillTimeout. A fill that times out keeps running in the background,
+// and its result is passed to late once it's done, or thrown away if late is
+// nil.
+func (c *Cache) callFill(s *shard, fn func() (resp.Object, error), late func(fillResult)) (resp.Object, error) {
+	if c.FillTimeout <= 0 {
+		return fn()
+	}
+
+	done := make(chan fillResult, 1)
+	go func() {
+		object, err := fn()
+		done <- fillResult{object, err}
+	}()
+
+	timer := time.NewTimer(c.FillTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.object, result.err
+	case <-timer.C:
+		atomic.AddInt64(&c.FillTimeouts, 1)
+		if late != nil {
+			go func() { late(<-done) }()
+		} else {
+			go c.discardFill(s, done)
+		}
+		return nil, ErrFillTimeout
+	}
+}
+
+// discardFill waits for a cache fill that timed out and releases its object
+// (e.g. a DiskCache's space in its file) without caching it.
+func (c *Cache) discardFill(s *shard, done chan fillResult) {
+	result := <-done
+	if result.err != nil || c.onRemove == nil {
+		return
+	}
+	object, _, _ := unwrapFill(result.object)
+	s.Lock()
+	c.onRemove(object)
+	s.Unlock()
+}
+
+// waiters returns the number of calls waiting for another call's cache fill,
+// in total, for the key with the most waiters, and for each key that has any.
+func (c *Cache) waiters() (total, max int64, keys map[string]int64) {
+	keys = make(map[string]int64)
+	for _, s := range c.shards {
+		s.Lock()
+		for key, lock := range s.locks {
+			// One reference is the lock's holder
+			n := int64(lock.refs - 1)
+			if n == 0 {
+				continue
+			}
+			keys[key] = n
+			total += n
+			if n > max {
+				max = n
+			}
+		}
+		s.Unlock()
+	}
+	return total, max, keys
+}
@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"github.com/stvp/resp"
+	"testing"
+	"time"
+)
+
+// startSlowFill starts a Fetch of the given key whose cache fill blocks until
+// the returned channel is closed, and waits for the fill to start.
+func startSlowFill(cache *Cache, key string) chan bool {
+	started := make(chan bool)
+	release := make(chan bool)
+	go cache.Fetch(key, time.Now(), func() (resp.Object, error) {
+		close(started)
+		<-release
+		return resp.NewBulkString("slow"), nil
+	})
+	<-started
+	return release
+}
+
+func TestMaxWait(t *testing.T) {
+	cache := NewCache()
+	cache.MaxWait = 20 * time.Millisecond
+	release := startSlowFill(cache, "a")
+	defer close(release)
+
+	start := time.Now()
+	_, err := cache.Fetch("a", time.Now(), func() (resp.Object, error) {
+		t.Error("expected the waiter not to fill the cache")
+		return nil, nil
+	})
+	if err != ErrWaitTimeout {
+		t.Fatalf("expected ErrWaitTimeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected the waiter to give up after MaxWait, waited %s", elapsed)
+	}
+	if n := cache.Stats().WaitTimeouts; n != 1 {
+		t.Errorf("expected 1 wait timeout, got: %d", n)
+	}
+}
+
+func TestMaxWait_Stale(t *testing.T) {
+	cache := NewCache()
+	cache.MaxWait = 20 * time.Millisecond
+	cache.MaxStale = time.Minute
+	cache.StaleIfError = func(err error) bool { return err == ErrWaitTimeout }
+	cache.Set("a", resp.NewBulkString("old"))
+	time.Sleep(time.Millisecond)
+	release := startSlowFill(cache, "a")
+	defer close(release)
+
+	for _, fetch := range []func() (resp.Object, error){
+		func() (resp.Object, error) {
+			return cache.Fetch("a", time.Now(), func() (resp.Object, error) { return nil, nil })
+		},
+		func() (resp.Object, error) {
+			return cache.FetchStale("a", time.Now(), time.Now(), func() (resp.Object, error) { return nil, nil })
+		},
+	} {
+		obj, err := fetch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Raw()) != "$3\r\nold\r\n" {
+			t.Errorf("expected the stale value, got: %q", obj.Raw())
+		}
+	}
+	if n := cache.Stats().StaleErrorHits; n != 2 {
+		t.Errorf("expected 2 stale error hits, got: %d", n)
+	}
+}
+
+func TestFetchStale_DuringFill(t *testing.T) {
+	cache := NewCache()
+	cache.MaxWait = 200 * time.Millisecond
+	cache.Set("a", resp.NewBulkString("old"))
+	time.Sleep(time.Millisecond)
+	release := startSlowFill(cache, "a")
+	defer close(release)
+
+	// A stale value doesn't wait for the fill that's running
+	start := time.Now()
+	obj, err := cache.FetchStale("a", time.Now(), time.Now().Add(-time.Minute), func() (resp.Object, error) {
+		return resp.NewBulkString("new"), nil
+	})
+	if err != nil || string(obj.Raw()) != "$3\r\nold\r\n" {
+		t.Errorf("expected the stale value, got: %v, %v", obj, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected the stale value right away, waited %s", elapsed)
+	}
+}
+
+func TestFillTimeout(t *testing.T) {
+	cache := NewCache()
+	cache.FillTimeout = 20 * time.Millisecond
+	release := make(chan bool)
+
+	_, err := cache.Fetch("a", time.Now(), func() (resp.Object, error) {
+		<-release
+		return resp.NewBulkString("late"), nil
+	})
+	if err != ErrFillTimeout {
+		t.Fatalf("expected ErrFillTimeout, got: %v", err)
+	}
+	close(release)
+	if n := cache.Stats().FillTimeouts; n != 1 {
+		t.Errorf("expected 1 fill timeout, got: %d", n)
+	}
+
+	// The late result is cached once the fill is done
+	time.Sleep(10 * time.Millisecond)
+	obj, ok := cache.Get("a", time.Now().Add(-time.Minute))
+	if !ok || string(obj.Raw()) != "$4\r\nlate\r\n" {
+		t.Errorf("expected \"late\" to be cached, got: %v, %v", obj, ok)
+	}
+}
+
+func TestFillTimeout_Waiters(t *testing.T) {
+	cache := NewCache()
+	cache.FillTimeout = 20 * time.Millisecond
+	release := make(chan bool)
+	_, err := cache.Fetch("a", time.Now(), func() (resp.Object, error) {
+		<-release
+		return resp.NewBulkString("late"), nil
+	})
+	if err != ErrFillTimeout {
+		t.Fatalf("expected ErrFillTimeout, got: %v", err)
+	}
+
+	// Callers that come along while the fill is still running wait for its
+	// result instead of starting another fill
+	done := make(chan resp.Object)
+	go func() {
+		obj, err := cache.Fetch("a", time.Now().Add(-time.Minute), func() (resp.Object, error) {
+			t.Error("expected the waiter not to fill the cache")
+			return resp.NewBulkString("again"), nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- obj
+	}()
+	for i := 0; i < 100 && cache.Stats().Waiting == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if obj := <-done; obj == nil || string(obj.Raw()) != "$4\r\nlate\r\n" {
+		t.Errorf("expected \"late\", got: %v", obj)
+	}
+}
+
+func TestFillTimeout_Disk(t *testing.T) {
+	withDiskCache(func(cache *DiskCache) {
+		cache.FillTimeout = 20 * time.Millisecond
+		done := make(chan bool)
+		_, err := cache.Fetch("a", time.Now(), func() (resp.Object, error) {
+			defer close(done)
+			time.Sleep(50 * time.Millisecond)
+			return resp.NewBulkString("late"), nil
+		})
+		if err != ErrFillTimeout {
+			t.Fatalf("expected ErrFillTimeout, got: %v", err)
+		}
+
+		// The late result is cached in the file
+		<-done
+		time.Sleep(10 * time.Millisecond)
+		obj, ok := cache.Get("a", time.Now().Add(-time.Minute))
+		if !ok || string(obj.Raw()) != "$4\r\nlate\r\n" {
+			t.Errorf("expected \"late\" to be cached, got: %v, %v", obj, ok)
+		}
+	})
+}
+
+func TestWaiters(t *testing.T) {
+	cache := NewCache()
+	release := startSlowFill(cache, "a")
+	for i := 0; i < 3; i++ {
+		go cache.Fetch("a", time.Now(), func() (resp.Object, error) {
+			return resp.NewBulkString("b"), nil
+		})
+	}
+	go cache.Fetch("b", time.Now(), func() (resp.Object, error) {
+		return resp.NewBulkString("b"), nil
+	})
+
+	var stats Stats
+	for i := 0; i < 100; i++ {
+		if stats = cache.Stats(); stats.Waiting == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats.Waiting != 3 || stats.MaxWaiting != 3 {
+		t.Errorf("expected 3 waiters, got: %d waiting and %d max", stats.Waiting, stats.MaxWaiting)
+	}
+	if len(stats.WaitingKeys) != 1 || stats.WaitingKeys["a"] != 3 {
+		t.Errorf("expected 3 waiters for \"a\", got: %v", stats.WaitingKeys)
+	}
+
+	close(release)
+	for i := 0; i < 100 && cache.Stats().Waiting > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if stats = cache.Stats(); stats.Waiting != 0 || stats.MaxWaiting != 0 || len(stats.WaitingKeys) != 0 {
+		t.Errorf("expected no waiters, got: %d waiting, %d max and %v", stats.Waiting, stats.MaxWaiting, stats.WaitingKeys)
+	}
+}
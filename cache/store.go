@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"github.com/stvp/resp"
+	"sync/atomic"
+	"time"
+)
+
+// A Store caches RESP objects with string keys. Cache keeps objects in memory
+// and DiskCache keeps them in a local file. See Cache for details of each
+// method.
+type Store interface {
+	Fetch(key string, maxAge time.Time, fn func() (resp.Object, error)) (resp.Object, error)
+	FetchContext(ctx context.Context, key string, maxAge time.Time, fn func() (resp.Object, error)) (resp.Object, error)
+	FetchStaleContext(ctx context.Context, key string, maxAge, staleAge time.Time, fn func() (resp.Object, error)) (resp.Object, error)
+	Get(key string, maxAge time.Time) (resp.Object, bool)
+	Set(key string, object resp.Object)
+
+	Tag(key string, tags ...string)
+	InvalidateTag(tag string) int
+
+	Entries(tag string) []Entry
+	Entry(key string) (Entry, bool)
+	Delete(keys ...string) int
+	Flush() int
+	Expire(maxCount int, maxAge time.Time) int
+
+	Len() int
+	Bytes() int
+	Stats() Stats
+}
+
+// Stats is a snapshot of a Store's counters.
+type Stats struct {
+	Hits             int64
+	Misses           int64
+	Evictions        int64
+	StaleHits        int64
+	RevalidateErrors int64
+	StaleErrorHits   int64
+	Invalidations    int64
+	Refreshes        int64
+	CompressedIn     int64
+	CompressedOut    int64
+	CompressNanos    int64
+	DecompressNanos  int64
+	Rejections       int64
+	NegativeHits     int64
+	WaitTimeouts     int64
+	FillTimeouts     int64
+
+	// Waiting is the number of calls currently waiting for another call's
+	// cache fill, MaxWaiting is the most waiting for a single key, and
+	// WaitingKeys is the number waiting for each key that has any.
+	Waiting     int64
+	MaxWaiting  int64
+	WaitingKeys map[string]int64
+}
+
+// Stats returns the current values of the Cache's counters.
+func (c *Cache) Stats() Stats {
+	waiting, maxWaiting, waitingKeys := c.waiters()
+	return Stats{
+		Hits:             atomic.LoadInt64(&c.Hits),
+		Misses:           atomic.LoadInt64(&c.Misses),
+		Evictions:        atomic.LoadInt64(&c.Evictions),
+		StaleHits:        atomic.LoadInt64(&c.StaleHits),
+		RevalidateErrors: atomic.LoadInt64(&c.RevalidateErrors),
+		StaleErrorHits:   atomic.LoadInt64(&c.StaleErrorHits),
+		Invalidations:    atomic.LoadInt64(&c.Invalidations),
+		Refreshes:        atomic.LoadInt64(&c.Refreshes),
+		CompressedIn:     atomic.LoadInt64(&c.CompressedIn),
+		CompressedOut:    atomic.LoadInt64(&c.CompressedOut),
+		CompressNanos:    atomic.LoadInt64(&c.CompressNanos),
+		DecompressNanos:  atomic.LoadInt64(&c.DecompressNanos),
+		Rejections:       atomic.LoadInt64(&c.Rejections),
+		NegativeHits:     atomic.LoadInt64(&c.NegativeHits),
+		WaitTimeouts:     atomic.LoadInt64(&c.WaitTimeouts),
+		FillTimeouts:     atomic.LoadInt64(&c.FillTimeouts),
+		Waiting:          waiting,
+		MaxWaiting:       maxWaiting,
+		WaitingKeys:      waitingKeys,
+	}
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"github.com/stvp/resp"
+	"time"
+)
+
+// A TaggedObject is a resp.Object that's cached with the given tags. Cache
+// fill functions can return one so that the tags are attached in the same
+// step as the object is stored, and a simultaneous InvalidateTag either
+// removes the object or happens before it's cached. It may wrap an
+// ExpiringObject, but not the other way around. The Cache returns the wrapped
+// object itself.
+type TaggedObject struct {
+	resp.Object
+	Tags []string
+}
+
+// unwrapTagged returns the object wrapped by the given TaggedObject and its
+// tags, or the given object and no tags if it isn't one.
+func unwrapTagged(object resp.Object) (resp.Object, []string) {
+	if t, ok := object.(TaggedObject); ok {
+		return t.Object, t.Tags
+	}
+	return object, nil
+}
+
+// tagged wraps the given object in a TaggedObject if there are any tags.
+func tagged(object resp.Object, tags []string) resp.Object {
+	if len(tags) == 0 {
+		return object
+	}
+	return TaggedObject{object, tags}
+}
+
+// unwrapFill returns the object returned by a cache fill function along with
+// its expiry time and tags. See ExpiringObject and TaggedObject.
+func unwrapFill(object resp.Object) (resp.Object, time.Time, []string) {
+	object, tags := unwrapTagged(object)
+	object, expires := unwrapExpiring(object)
+	return object, expires, tags
+}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"github.com/stvp/resp"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTaggedObject(t *testing.T) {
+	value := resp.NewBulkString("value")
+	fill := func() (resp.Object, error) {
+		return TaggedObject{ExpiringObject{value, time.Now().Add(time.Hour)}, []string{"x", "y"}}, nil
+	}
+
+	test := func(store Store) {
+		obj, err := store.Fetch("key", time.Now(), fill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Raw()) != string(value.Raw()) {
+			t.Errorf("expected %q, got: %q", value.Raw(), obj.Raw())
+		}
+		if _, ok := obj.(TaggedObject); ok {
+			t.Errorf("expected the wrapped object, got: %#v", obj)
+		}
+		entry, ok := store.Entry("key")
+		if !ok || !reflect.DeepEqual(entry.Tags, []string{"x", "y"}) || entry.Expires.IsZero() {
+			t.Errorf("expected tags and an expiry time, got: %#v", entry)
+		}
+
+		// Refilled values keep their old tags
+		store.Set("key", TaggedObject{value, []string{"z"}})
+		if entry, _ := store.Entry("key"); !reflect.DeepEqual(entry.Tags, []string{"x", "y", "z"}) {
+			t.Errorf("expected tags x, y and z, got: %#v", entry.Tags)
+		}
+		if n := store.InvalidateTag("y"); n != 1 {
+			t.Errorf("expected 1 invalidation, got: %d", n)
+		}
+	}
+	test(NewCache())
+	withDiskCache(func(cache *DiskCache) { test(cache) })
+}
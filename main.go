@@ -2,9 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/stvp/aorta/cache"
 	"github.com/stvp/aorta/proxy"
+	"github.com/stvp/aorta/redis"
 	"github.com/stvp/stvp/log"
 	. "github.com/stvp/stvp/log/helpers"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +22,50 @@ var (
 	password  = flag.String("password", "", "required password before clients can proxy commands")
 	clientttl = flag.Int("clientttl", 300, "timeout for client connections, in seconds")
 	serverttl = flag.Int("serverttl", 2, "timeout for server connections, in seconds")
+	recovery  = flag.Int("recovery", 30, "delay before a failed-over server connection retries its primary address, in seconds")
+
+	// Timeout flags, in milliseconds. These override clientttl and serverttl.
+	clientReadTimeout  = flag.Int("clientreadtimeout", 0, "read timeout for client connections, in milliseconds (default: clientttl)")
+	clientWriteTimeout = flag.Int("clientwritetimeout", 0, "write timeout for client connections, in milliseconds (default: clientttl)")
+	serverDialTimeout  = flag.Int("serverdialtimeout", 0, "dial timeout for server connections, in milliseconds (default: serverttl)")
+	serverReadTimeout  = flag.Int("serverreadtimeout", 0, "read timeout for server connections, in milliseconds (default: serverttl)")
+	serverWriteTimeout = flag.Int("serverwritetimeout", 0, "write timeout for server connections, in milliseconds (default: serverttl)")
+
+	// Cache flags
+	cacheStore    = flag.String("cachestore", "memory", "where to keep cached replies: memory or disk")
+	cacheFile     = flag.String("cachefile", "aorta.cache", "file to keep cached replies in with -cachestore=disk")
+	cacheMaxBytes = flag.Int("cachemaxbytes", 0, "maximum size of all cached replies, in bytes (default: no limit)")
+	admission     = flag.Bool("admission", false, "with -cachemaxbytes, don't let rarely fetched replies evict more popular ones")
+	keyTTL        = flag.Bool("keyttl", false, "fetch the TTL of single-key reads along with them and don't cache them past it")
+	negativeTTL   = flag.Int("negativettl", 0, "maximum age of cached nil and error replies, in seconds (default: same as other replies)")
+	negativeErrs  = flag.String("negativeerrors", "", "comma-separated list of error classes to cache, e.g. WRONGTYPE")
+	peers         = flag.String("peers", "", "comma-separated list of host:port addresses of aorta instances to share cached replies with, including this one")
+	peerSelf      = flag.String("peerself", "", "host:port address that the other -peers use to reach this instance")
+	invalidation  = flag.Bool("invalidation", false, "listen for key changes on servers with cached replies and invalidate them")
+	cacheable     = flag.String("cacheable", "", "comma-separated list of extra commands that can be cached, e.g. module commands")
+	cacheUnknown  = flag.Bool("cacheunknown", false, "allow caching commands that aren't known to be read-only")
+	hashKeys      = flag.Bool("hashkeys", false, "store cached replies under a SHA-256 sum of the command instead of the full command")
+	refreshAhead  = flag.Float64("refreshahead", 0, "refresh hot cached replies in the background once they're within this fraction of their max age, e.g. 0.1 (default: disabled)")
+	refreshHits   = flag.Int("refreshminhits", 10, "number of fetches before a cached reply is refreshed ahead of time")
+	refreshCold   = flag.Int("refreshcold", 60, "stop refreshing cached replies that haven't been fetched for this many seconds")
+	refreshConns  = flag.Int("refreshconcurrency", 4, "maximum number of cached replies to refresh at once")
+	compress      = flag.String("compress", "", "codec to compress cached replies with: flate (default: no compression)")
+	compressMin   = flag.Int("compressminbytes", 1024, "minimum size of cached replies to compress, in bytes")
+	snapshot      = flag.String("snapshot", "", "file to save cached replies to periodically and load them from on startup")
+	snapshotEvery = flag.Int("snapshotinterval", 60, "interval, in seconds, to save cached replies to the -snapshot file")
+	warmup        = flag.String("warmup", "", "file listing CACHED commands to fill the cache with before accepting clients")
+	warmupBg      = flag.Bool("warmupbackground", false, "fill the -warmup commands in the background while accepting clients")
+	staleIfError  = flag.Int("staleiferror", 0, "serve cached replies up to this many seconds old when a server can't be reached (default: disabled)")
+	maxWait       = flag.Int("maxwait", 0, "maximum time to wait for another client's fill of the same cached reply, in milliseconds (default: no limit)")
+	fillTimeout   = flag.Int("filltimeout", 0, "maximum time for a cache fill, in milliseconds (default: no limit besides the server timeouts)")
+
+	// Mirroring flags
+	shadow        = flag.String("shadow", "", "host:port of a shadow Redis server to mirror commands to")
+	shadowAuth    = flag.String("shadowauth", "", "password for the shadow Redis server")
+	shadowSource  = flag.String("shadowsource", "", "only mirror commands sent to this host:port (default: all servers)")
+	shadowQueue   = flag.Int("shadowqueue", 1024, "number of mirrored commands to buffer before dropping them")
+	shadowCompare = flag.Bool("shadowcompare", false, "compare shadow replies with primary replies")
+	shadowDiffLog = flag.String("shadowdifflog", "", "file to log differing replies to (default: stdout)")
 
 	// Logging flags
 	logInterval     = flag.Int("loginterval", 15, "interval, in seconds, to log stats to stdout, LogEntries, etc.")
@@ -43,20 +95,255 @@ func main() {
 	// Trigger PagerDuty if we panic
 	defer log.LogPanic(log.CRIT)
 
-	ctimeout := time.Duration(*clientttl) * time.Second
-	stimeout := time.Duration(*serverttl) * time.Second
+	ctimeouts := redis.NewTimeouts(time.Duration(*clientttl) * time.Second)
+	ctimeouts.Read = millisOr(*clientReadTimeout, ctimeouts.Read)
+	ctimeouts.Write = millisOr(*clientWriteTimeout, ctimeouts.Write)
 
-	server := proxy.NewServer(*bind, *password, ctimeout, stimeout)
+	stimeouts := redis.NewTimeouts(time.Duration(*serverttl) * time.Second)
+	stimeouts.Dial = millisOr(*serverDialTimeout, stimeouts.Dial)
+	stimeouts.Read = millisOr(*serverReadTimeout, stimeouts.Read)
+	stimeouts.Write = millisOr(*serverWriteTimeout, stimeouts.Write)
+
+	server := proxy.NewServerTimeouts(*bind, *password, ctimeouts, stimeouts)
+	server.Pool.RecoveryDelay = time.Duration(*recovery) * time.Second
+	memory, store := newCache()
+	server.Cache = store
+	server.Invalidation = *invalidation
+	server.HashKeys = *hashKeys
+	if key := digestKey(); key != nil {
+		server.DigestKey = key
+	}
+	server.KeyTTL = *keyTTL
+	server.CacheUnknown = *cacheUnknown
+	if len(*cacheable) > 0 {
+		server.CacheableCommands = map[string]bool{}
+		for _, name := range strings.Split(*cacheable, ",") {
+			server.CacheableCommands[strings.ToUpper(strings.TrimSpace(name))] = true
+		}
+	}
+	if len(*negativeErrs) > 0 {
+		server.NegativeErrors = map[string]bool{}
+		for _, class := range strings.Split(*negativeErrs, ",") {
+			server.NegativeErrors[strings.ToUpper(strings.TrimSpace(class))] = true
+		}
+	}
+	if len(*peers) > 0 {
+		server.Peers = newPeers(stimeouts)
+	}
+	if len(*shadow) > 0 {
+		server.Mirror = newMirror(stimeouts)
+	}
+	snapshots := len(*snapshot) > 0
+	if snapshots && *cacheStore != "memory" {
+		WARN("Cache snapshots are only supported with -cachestore=memory")
+		snapshots = false
+	}
+	if snapshots {
+		loadSnapshot(memory)
+	}
+	if len(*warmup) > 0 {
+		runWarmup(server)
+	}
 	err := server.Listen()
 	if err != nil {
 		panic(err)
 	}
 
 	go runLogger(server)
+	if *refreshAhead > 0 {
+		go runRefresh(memory)
+	}
+	if snapshots {
+		go runSnapshots(memory)
+	}
 
 	<-make(chan bool)
 }
 
+// millisOr returns the given number of milliseconds as a time.Duration, or
+// the default if ms is zero.
+func millisOr(ms int, def time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return def
+}
+
+// newCache returns the cache.Store chosen with -cachestore, configured with
+// the cache flags, along with the Cache that holds its index.
+func newCache() (*cache.Cache, cache.Store) {
+	var memory *cache.Cache
+	var store cache.Store
+	switch *cacheStore {
+	case "memory":
+		memory = cache.NewCache()
+		store = memory
+	case "disk":
+		disk, err := cache.NewDiskCache(*cacheFile)
+		if err != nil {
+			panic(err)
+		}
+		memory = disk.Cache
+		store = disk
+	default:
+		panic("unknown -cachestore: " + *cacheStore)
+	}
+
+	memory.MaxBytes = *cacheMaxBytes
+	memory.Admission = *admission
+	if *negativeTTL > 0 {
+		memory.IsNegative = proxy.IsNegativeReply
+		memory.NegativeMaxAge = time.Duration(*negativeTTL) * time.Second
+	}
+	memory.RefreshAhead = *refreshAhead
+	memory.RefreshMinHits = *refreshHits
+	memory.RefreshColdAfter = time.Duration(*refreshCold) * time.Second
+	memory.RefreshConcurrency = *refreshConns
+	switch *compress {
+	case "":
+	case "flate":
+		memory.Codec = cache.FlateCodec{}
+	default:
+		panic("unknown -compress codec: " + *compress)
+	}
+	memory.CompressMinBytes = *compressMin
+	memory.MaxWait = time.Duration(*maxWait) * time.Millisecond
+	memory.FillTimeout = time.Duration(*fillTimeout) * time.Millisecond
+	if *staleIfError > 0 {
+		memory.StaleIfError = staleIfErrorPolicy
+		memory.MaxStale = time.Duration(*staleIfError) * time.Second
+	}
+	return memory, store
+}
+
+// staleIfErrorPolicy allows stale cached replies in place of errors for
+// servers that can't be reached and for slow cache fills. Only CACHED and
+// CACHEDSTALE commands go through the cache, so other commands (e.g. writes)
+// never get a stale reply.
+func staleIfErrorPolicy(err error) bool {
+	return redis.IsConnError(err) || err == cache.ErrWaitTimeout || err == cache.ErrFillTimeout
+}
+
+// digestKey returns the key for the Redis password digests in cache keys (see
+// proxy.Server.DigestKey), or nil to use a random key. Peers derive theirs from
+// the proxy password, which they share. Snapshots keep theirs in a file next to
+// the snapshot, so that the snapshot's cache keys still match after a restart.
+// DiskCache files are truncated on startup, so they can use a random key.
+func digestKey() []byte {
+	if len(*peers) > 0 {
+		return proxy.PeerDigestKey(*password)
+	}
+	if len(*snapshot) > 0 && *cacheStore == "memory" {
+		key, err := loadDigestKey(*snapshot + ".key")
+		if err != nil {
+			WARN("Couldn't load the cache snapshot key, using a random key: %s", err.Error())
+			return nil
+		}
+		return key
+	}
+	return nil
+}
+
+// loadDigestKey reads the key in the file at the given path, or creates the
+// file with a random key if it doesn't exist.
+func loadDigestKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil && len(key) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	if err == nil || !os.IsNotExist(err) {
+		return key, err
+	}
+
+	key = proxy.NewDigestKey()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(key); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+func newPeers(timeouts redis.Timeouts) *proxy.Peers {
+	if len(*peerSelf) == 0 {
+		panic("-peers requires -peerself")
+	}
+	var addresses []string
+	for _, address := range strings.Split(*peers, ",") {
+		addresses = append(addresses, strings.TrimSpace(address))
+	}
+	p := proxy.NewPeers(*peerSelf, *password, timeouts)
+	p.Set(addresses...)
+	return p
+}
+
+func newMirror(timeouts redis.Timeouts) *proxy.Mirror {
+	var diffLog io.Writer = os.Stdout
+	if len(*shadowDiffLog) > 0 {
+		f, err := os.OpenFile(*shadowDiffLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			panic(err)
+		}
+		diffLog = f
+	}
+
+	mirror := proxy.NewMirror(*shadow, *shadowAuth, timeouts, *shadowQueue, diffLog)
+	mirror.Source = *shadowSource
+	mirror.Compare = *shadowCompare
+	return mirror
+}
+
+// loadSnapshot warms the cache with replies saved by a previous run. Snapshots
+// that can't be read are logged and ignored.
+func loadSnapshot(c *cache.Cache) {
+	loaded, err := c.LoadSnapshot(*snapshot)
+	if err != nil {
+		WARN("Ignoring cache snapshot %s: %s", *snapshot, err.Error())
+		return
+	}
+	INFO("Loaded %d cached replies from %s", loaded, *snapshot)
+}
+
+// runWarmup fills the cache with the commands in the -warmup file, either
+// before returning or in the background.
+func runWarmup(server *proxy.Server) {
+	f, err := os.Open(*warmup)
+	if err != nil {
+		panic(err)
+	}
+	commands, err := proxy.ParseWarmup(f)
+	f.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	if *warmupBg {
+		server.WarmupBackground(commands)
+	} else {
+		server.Warmup(commands)
+	}
+}
+
+func runSnapshots(c *cache.Cache) {
+	interval := time.Duration(*snapshotEvery) * time.Second
+	for range time.Tick(interval) {
+		err := c.SaveSnapshot(*snapshot)
+		if err != nil {
+			ERROR("Couldn't save cache snapshot: %s", err.Error())
+		}
+	}
+}
+
+func runRefresh(c *cache.Cache) {
+	for range time.Tick(100 * time.Millisecond) {
+		c.Refresh()
+	}
+}
+
 func runLogger(server *proxy.Server) {
 	INFO("")
 	INFO("              _.---._    /\\\\")
@@ -72,6 +359,27 @@ func runLogger(server *proxy.Server) {
 	for now := range time.Tick(interval) {
 		INFO("# Stats @ %s", now.UTC().Format(time.RFC1123))
 		INFO("current_server_conns:%d\tcurrent_client_conns:%d\ttotal_client_conns:%d", server.Pool.Len(), server.CurrentClientConns, server.TotalClientConns)
-		INFO("cache_keys:%d\tcache_hits:%d\tcache_misses:%d", server.Cache.Len(), server.Cache.Hits, server.Cache.Misses)
+		stats := server.Cache.Stats()
+		INFO("cache_keys:%d\tcache_hits:%d\tcache_misses:%d\tcache_bytes:%d\tcache_evictions:%d", server.Cache.Len(), stats.Hits, stats.Misses, server.Cache.Bytes(), stats.Evictions)
+		if *admission {
+			INFO("cache_rejections:%d", stats.Rejections)
+		}
+		for _, conn := range server.Pool.FailedOver() {
+			INFO("failover_primary:%s\tfailover_active:%s", conn.Addresses()[0], conn.Address())
+		}
+		INFO("cache_stale_hits:%d\tcache_revalidate_errors:%d\tcache_stale_error_hits:%d\tcache_negative_hits:%d", stats.StaleHits, stats.RevalidateErrors, stats.StaleErrorHits, stats.NegativeHits)
+		INFO("cache_waiting:%d\tcache_max_waiting:%d\tcache_wait_timeouts:%d\tcache_fill_timeouts:%d", stats.Waiting, stats.MaxWaiting, stats.WaitTimeouts, stats.FillTimeouts)
+		if *refreshAhead > 0 {
+			INFO("cache_refreshes:%d", stats.Refreshes)
+		}
+		if len(*compress) > 0 {
+			INFO("cache_compressed_bytes_in:%d\tcache_compressed_bytes_out:%d\tcache_compress_time_ms:%d\tcache_decompress_time_ms:%d", stats.CompressedIn, stats.CompressedOut, stats.CompressNanos/int64(time.Millisecond), stats.DecompressNanos/int64(time.Millisecond))
+		}
+		if server.Peers != nil {
+			INFO("peer_requests:%d\tpeer_invalidations:%d\tpeer_errors:%d\tpeer_served:%d", atomic.LoadInt64(&server.Peers.Requests), atomic.LoadInt64(&server.Peers.Invalidations), atomic.LoadInt64(&server.Peers.Errors), atomic.LoadInt64(&server.Peers.Served))
+		}
+		if server.Mirror != nil {
+			INFO("mirror_address:%s\tmirror_sent:%d\tmirror_errors:%d\tmirror_dropped:%d\tmirror_diffs:%d", server.Mirror.Address(), atomic.LoadInt64(&server.Mirror.Mirrored), atomic.LoadInt64(&server.Mirror.Errors), atomic.LoadInt64(&server.Mirror.Dropped), atomic.LoadInt64(&server.Mirror.Diffs))
+		}
 	}
 }
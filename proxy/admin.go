@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stvp/aorta/cache"
+	"github.com/stvp/aorta/redis"
+	"github.com/stvp/resp"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// handleCache handles the CACHE administration commands (STATS, FLUSH, DEL,
+// KEYS, INFO and INVALIDATE) and returns the reply for the client. See the README.
+func (s *Server) handleCache(args []string, server *redis.ServerConn) []byte {
+	if len(args) < 2 {
+		return resp.NewError("ERR wrong number of arguments for 'cache' command")
+	}
+
+	switch subcommand := strings.ToUpper(args[1]); {
+	case subcommand == "STATS" && len(args) == 2:
+		return resp.NewBulkString(s.cacheStatsInfo()).Raw()
+	case subcommand == "FLUSH" && len(args) == 2:
+		return integerReply(s.Cache.Flush())
+	case subcommand == "FLUSH" && len(args) == 4:
+		address := fmt.Sprintf("%s:%s", args[2], args[3])
+		return integerReply(s.deleteEntries(func(e entryInfo) bool {
+			return e.address == address
+		}))
+	case subcommand == "DEL" && len(args) == 4:
+		command := strings.ToUpper(args[2])
+		return integerReply(s.deleteEntries(func(e entryInfo) bool {
+			return e.command == command && e.matches(args[3])
+		}))
+	case subcommand == "KEYS" && len(args) <= 3:
+		var lines []string
+		for _, entry := range s.Cache.Entries("") {
+			info := newEntryInfo(entry)
+			if len(args) == 2 || info.matches(args[2]) {
+				lines = append(lines, info.String())
+			}
+		}
+		return bulkArray(lines)
+	case subcommand == "INFO" && len(args) >= 3:
+		if server == nil {
+			return resp.NewError("aorta: proxy destination not set")
+		}
+		entry, ok := s.Cache.Entry(s.cacheKey(resp.NewCommand(args[2:]...), server))
+		if !ok {
+			return []byte("$-1\r\n")
+		}
+		return resp.NewBulkString(newEntryInfo(entry).String()).Raw()
+	case subcommand == "INVALIDATE" && len(args) >= 4 && strings.ToUpper(args[2]) == "TAG":
+		var removed int
+		for _, tag := range args[3:] {
+			removed += s.Cache.InvalidateTag(userTag(tag))
+		}
+		return integerReply(removed)
+	case subcommand == "INVALIDATE" && len(args) >= 3 && strings.ToUpper(args[2]) != "TAG":
+		return resp.NewError("ERR syntax error")
+	case subcommand == "STATS" || subcommand == "FLUSH" || subcommand == "DEL" || subcommand == "KEYS" || subcommand == "INFO" || subcommand == "INVALIDATE":
+		return resp.NewError("ERR wrong number of arguments for 'cache " + strings.ToLower(subcommand) + "' command")
+	default:
+		return resp.NewError("ERR unknown subcommand '" + args[1] + "' for 'cache' command")
+	}
+}
+
+// cacheStatsInfo returns cache stats in the same format as Redis's INFO.
+func (s *Server) cacheStatsInfo() string {
+	var buf bytes.Buffer
+	stats := s.Cache.Stats()
+	fmt.Fprintf(&buf, "# Cache\r\n")
+	fmt.Fprintf(&buf, "keys:%d\r\n", s.Cache.Len())
+	fmt.Fprintf(&buf, "bytes:%d\r\n", s.Cache.Bytes())
+	fmt.Fprintf(&buf, "hits:%d\r\n", stats.Hits)
+	fmt.Fprintf(&buf, "misses:%d\r\n", stats.Misses)
+	fmt.Fprintf(&buf, "negative_hits:%d\r\n", stats.NegativeHits)
+	fmt.Fprintf(&buf, "evictions:%d\r\n", stats.Evictions)
+	fmt.Fprintf(&buf, "rejections:%d\r\n", stats.Rejections)
+	fmt.Fprintf(&buf, "invalidations:%d\r\n", stats.Invalidations)
+	fmt.Fprintf(&buf, "stale_hits:%d\r\n", stats.StaleHits)
+	fmt.Fprintf(&buf, "stale_error_hits:%d\r\n", stats.StaleErrorHits)
+	fmt.Fprintf(&buf, "waiting:%d\r\n", stats.Waiting)
+	fmt.Fprintf(&buf, "max_waiting:%d\r\n", stats.MaxWaiting)
+	fmt.Fprintf(&buf, "wait_timeouts:%d\r\n", stats.WaitTimeouts)
+	fmt.Fprintf(&buf, "fill_timeouts:%d\r\n", stats.FillTimeouts)
+	fmt.Fprintf(&buf, "refreshes:%d\r\n", stats.Refreshes)
+	fmt.Fprintf(&buf, "compressed_bytes_in:%d\r\n", stats.CompressedIn)
+	fmt.Fprintf(&buf, "compressed_bytes_out:%d\r\n", stats.CompressedOut)
+	fmt.Fprintf(&buf, "compression_ratio:%.2f\r\n", compressionRatio(stats))
+	fmt.Fprintf(&buf, "compress_time_ms:%.3f\r\n", float64(stats.CompressNanos)/float64(time.Millisecond))
+	fmt.Fprintf(&buf, "decompress_time_ms:%.3f\r\n", float64(stats.DecompressNanos)/float64(time.Millisecond))
+	if s.Peers != nil {
+		fmt.Fprintf(&buf, "peer_requests:%d\r\n", atomic.LoadInt64(&s.Peers.Requests))
+		fmt.Fprintf(&buf, "peer_invalidations:%d\r\n", atomic.LoadInt64(&s.Peers.Invalidations))
+		fmt.Fprintf(&buf, "peer_errors:%d\r\n", atomic.LoadInt64(&s.Peers.Errors))
+		fmt.Fprintf(&buf, "peer_served:%d\r\n", atomic.LoadInt64(&s.Peers.Served))
+	}
+
+	keys := map[string]int{}
+	for _, entry := range s.Cache.Entries("") {
+		keys[newEntryInfo(entry).address]++
+	}
+	servers, commands := s.cacheStats.snapshot()
+
+	fmt.Fprintf(&buf, "\r\n# Servers\r\n")
+	for _, address := range sortedKeys(servers) {
+		counts := servers[address]
+		fmt.Fprintf(&buf, "%s:keys=%d,hits=%d,misses=%d\r\n", address, keys[address], counts.Hits, counts.Misses)
+	}
+
+	fmt.Fprintf(&buf, "\r\n# Commands\r\n")
+	for _, command := range sortedKeys(commands) {
+		counts := commands[command]
+		fmt.Fprintf(&buf, "%s:hits=%d,misses=%d\r\n", strings.ToLower(command), counts.Hits, counts.Misses)
+	}
+
+	fmt.Fprintf(&buf, "\r\n# Waiting\r\n")
+	for _, line := range waitingInfo(stats.WaitingKeys, maxWaitingKeys) {
+		fmt.Fprintf(&buf, "%s\r\n", line)
+	}
+
+	return buf.String()
+}
+
+// maxWaitingKeys is the number of cached replies with the most waiting
+// clients that CACHE STATS lists.
+const maxWaitingKeys = 10
+
+// waitingInfo describes up to max of the given cache keys with the most
+// clients waiting for them to be filled, most first.
+func waitingInfo(waiting map[string]int64, max int) []string {
+	keys := make([]string, 0, len(waiting))
+	for key := range waiting {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if waiting[keys[i]] != waiting[keys[j]] {
+			return waiting[keys[i]] > waiting[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > max {
+		keys = keys[:max]
+	}
+
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		address, args, ok := decodeCacheKey(key)
+		if !ok {
+			lines[i] = fmt.Sprintf("%x:waiting=%d", key, waiting[key])
+			continue
+		}
+		command := strings.ToUpper(args[0])
+		var keys []string
+		if spec, ok := readCommands[command]; ok {
+			keys = spec.keys(args)
+		}
+		lines[i] = fmt.Sprintf("%s:waiting=%d,command=%s,keys=%s", address, waiting[key], strings.ToLower(command), strings.Join(keys, ","))
+	}
+	return lines
+}
+
+// compressionRatio returns the ratio of the size of compressed cached replies
+// before and after compression, or zero if nothing has been compressed.
+func compressionRatio(stats cache.Stats) float64 {
+	if stats.CompressedOut == 0 {
+		return 0
+	}
+	return float64(stats.CompressedIn) / float64(stats.CompressedOut)
+}
+
+// deleteEntries removes all cached replies that match the given function and
+// returns the number removed.
+func (s *Server) deleteEntries(match func(entryInfo) bool) int {
+	var keys []string
+	for _, entry := range s.Cache.Entries("") {
+		if match(newEntryInfo(entry)) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	return s.Cache.Delete(keys...)
+}
+
+// entryInfo describes a cached reply using its tags.
+type entryInfo struct {
+	address string
+	command string
+	keys    []string
+	tags    []string
+	age     time.Duration
+	size    int
+}
+
+func newEntryInfo(entry cache.Entry) entryInfo {
+	info := entryInfo{
+		age:  time.Since(entry.Timestamp),
+		size: entry.Size,
+	}
+	for _, tag := range entry.Tags {
+		kind, address, value := parseTag(tag)
+		if kind == userTagKind {
+			// Client tags don't belong to a server
+			info.tags = append(info.tags, value)
+			continue
+		}
+		info.address = address
+		switch kind {
+		case commandTagKind:
+			info.command = value
+		case keyTagKind:
+			info.keys = append(info.keys, value)
+		}
+	}
+	return info
+}
+
+// matches returns true if any of the keys read by the cached reply match the
+// given glob-style pattern.
+func (e entryInfo) matches(pattern string) bool {
+	for _, key := range e.keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e entryInfo) String() string {
+	s := fmt.Sprintf("server=%s command=%s keys=%s age=%.3f size=%d", e.address, strings.ToLower(e.command), strings.Join(e.keys, ","), e.age.Seconds(), e.size)
+	if len(e.tags) > 0 {
+		s += " tags=" + strings.Join(e.tags, ",")
+	}
+	return s
+}
+
+func bulkArray(items []string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(items))
+	for _, item := range items {
+		buf.Write(resp.NewBulkString(item).Raw())
+	}
+	return buf.Bytes()
+}
+
+func integerReply(n int) []byte {
+	return []byte(fmt.Sprintf(":%d\r\n", n))
+}
+
+func sortedKeys(m map[string]hitCounts) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
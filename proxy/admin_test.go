@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"github.com/stvp/resp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fillCache(proxy *Server, address, command string, keys ...string) string {
+	backend := address + "\x00pw"
+	key := backend + command + strings.Join(keys, "")
+	proxy.Cache.Fetch(key, time.Now(), func() (resp.Object, error) {
+		return resp.NewBulkString("value"), nil
+	})
+	tags := []string{backendTag(backend), commandTag(backend, command)}
+	for _, k := range keys {
+		tags = append(tags, keyTag(backend, k))
+	}
+	proxy.Cache.Tag(key, tags...)
+	return key
+}
+
+func TestHandleCache(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", time.Millisecond, time.Millisecond)
+	fillCache(proxy, "host1:6379", "GET", "user:1")
+	fillCache(proxy, "host1:6379", "GET", "post:1")
+	fillCache(proxy, "host1:6379", "MGET", "user:1", "user:2")
+	fillCache(proxy, "host2:6379", "GET", "user:1")
+
+	tests := []struct {
+		args     []string
+		contains string
+	}{
+		{[]string{"CACHE"}, "-ERR wrong number of arguments for 'cache' command"},
+		{[]string{"CACHE", "NOPE"}, "-ERR unknown subcommand 'NOPE' for 'cache' command"},
+		{[]string{"CACHE", "DEL", "GET"}, "-ERR wrong number of arguments for 'cache del' command"},
+		{[]string{"CACHE", "INFO", "GET", "user:1"}, "-aorta: proxy destination not set"},
+		{[]string{"CACHE", "STATS"}, "keys:4\r\n"},
+		{[]string{"CACHE", "STATS"}, "compression_ratio:0.00\r\n"},
+		{[]string{"CACHE", "STATS"}, "max_waiting:0\r\n"},
+		{[]string{"CACHE", "KEYS"}, "*4\r\n"},
+		{[]string{"CACHE", "KEYS", "post:*"}, "server=host1:6379 command=get keys=post:1 age="},
+		{[]string{"CACHE", "DEL", "get", "user:*"}, ":2\r\n"},
+		{[]string{"CACHE", "KEYS", "user:*"}, "server=host1:6379 command=mget keys=user:1,user:2 age="},
+		{[]string{"CACHE", "FLUSH", "host1", "6379"}, ":2\r\n"},
+		{[]string{"CACHE", "FLUSH"}, ":0\r\n"},
+	}
+	for i, test := range tests {
+		got := string(proxy.handleCache(test.args, nil))
+		if !strings.Contains(got, test.contains) {
+			t.Errorf("tests[%d]: expected %#v to contain %#v", i, got, test.contains)
+		}
+	}
+}
+
+func TestHandleCacheInvalidateTag(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", time.Millisecond, time.Millisecond)
+	proxy.Cache.Tag(fillCache(proxy, "host1:6379", "GET", "user:42:name"), userTag("user:42"))
+	proxy.Cache.Tag(fillCache(proxy, "host1:6379", "HGETALL", "user:42"), userTag("user:42"), userTag("users"))
+	proxy.Cache.Tag(fillCache(proxy, "host2:6379", "ZRANGE", "user:42:posts"), userTag("user:42"))
+	proxy.Cache.Tag(fillCache(proxy, "host1:6379", "GET", "user:43:name"), userTag("user:43"))
+
+	tests := []struct {
+		args     []string
+		contains string
+	}{
+		{[]string{"CACHE", "INVALIDATE"}, "-ERR wrong number of arguments for 'cache invalidate' command"},
+		{[]string{"CACHE", "INVALIDATE", "TAG"}, "-ERR wrong number of arguments for 'cache invalidate' command"},
+		{[]string{"CACHE", "INVALIDATE", "NOPE", "user:42"}, "-ERR syntax error"},
+		{[]string{"CACHE", "KEYS", "user:42"}, "server=host1:6379 command=hgetall keys=user:42 age="},
+		{[]string{"CACHE", "KEYS", "user:42"}, " tags=user:42,users"},
+		{[]string{"CACHE", "INVALIDATE", "tag", "user:42"}, ":3\r\n"},
+		{[]string{"CACHE", "INVALIDATE", "TAG", "user:42", "users"}, ":0\r\n"},
+		{[]string{"CACHE", "KEYS"}, "*1\r\n"},
+		{[]string{"CACHE", "INVALIDATE", "TAG", "nope", "user:43"}, ":1\r\n"},
+	}
+	for i, test := range tests {
+		got := string(proxy.handleCache(test.args, nil))
+		if !strings.Contains(got, test.contains) {
+			t.Errorf("tests[%d]: expected %#v to contain %#v", i, got, test.contains)
+		}
+	}
+}
+
+func TestWaitingInfo(t *testing.T) {
+	waiting := map[string]int64{
+		encodeCacheKey("host1:6379", "pw", byteArgs([]string{"get", "a"}), false):       1,
+		encodeCacheKey("host1:6379", "pw", byteArgs([]string{"MGET", "b", "c"}), false): 3,
+		encodeCacheKey("host2:6379", "pw", byteArgs([]string{"GET", "d"}), true):        2,
+		encodeCacheKey("host2:6379", "pw", byteArgs([]string{"HGETALL", "e"}), false):   1,
+	}
+	got := waitingInfo(waiting, 3)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 lines, got: %#v", got)
+	}
+	if expected := "host1:6379:waiting=3,command=mget,keys=b,c"; got[0] != expected {
+		t.Errorf("expected %q, got: %q", expected, got[0])
+	}
+	if !strings.HasSuffix(got[1], ":waiting=2") {
+		t.Errorf("expected a hashed key with 2 waiting, got: %q", got[1])
+	}
+	if !strings.Contains(got[2], ":waiting=1,command=") {
+		t.Errorf("expected a key with 1 waiting, got: %q", got[2])
+	}
+}
@@ -0,0 +1,328 @@
+package proxy
+
+import "strings"
+
+// A keySpec describes where the Redis keys are in a command's arguments, in
+// the same way as Redis's COMMAND reply: the position of the first and last
+// key and the step between keys. A negative last position counts back from the
+// end of the arguments, so -1 is the last argument.
+type keySpec struct {
+	first int
+	last  int
+	step  int
+}
+
+// keys returns the Redis keys in the given command arguments.
+func (k keySpec) keys(args []string) []string {
+	last := k.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	var keys []string
+	for i := k.first; i <= last && i < len(args); i += k.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+var (
+	oneKey       = keySpec{1, 1, 1}
+	twoKeys      = keySpec{1, 2, 1}
+	allKeys      = keySpec{1, -1, 1}
+	keyValues    = keySpec{1, -1, 2}
+	secondKeys   = keySpec{2, -1, 1}
+	blockingKeys = keySpec{1, -2, 1} // all but the last argument, a timeout
+)
+
+// readCommands lists commands that only read the keys they're given.
+var readCommands = map[string]keySpec{
+	"BITCOUNT":         oneKey,
+	"BITPOS":           oneKey,
+	"DUMP":             oneKey,
+	"EXISTS":           allKeys,
+	"GEODIST":          oneKey,
+	"GEOHASH":          oneKey,
+	"GEOPOS":           oneKey,
+	"GET":              oneKey,
+	"GETBIT":           oneKey,
+	"GETRANGE":         oneKey,
+	"HEXISTS":          oneKey,
+	"HGET":             oneKey,
+	"HGETALL":          oneKey,
+	"HKEYS":            oneKey,
+	"HLEN":             oneKey,
+	"HMGET":            oneKey,
+	"HSCAN":            oneKey,
+	"HSTRLEN":          oneKey,
+	"HVALS":            oneKey,
+	"LINDEX":           oneKey,
+	"LLEN":             oneKey,
+	"LRANGE":           oneKey,
+	"MGET":             allKeys,
+	"PFCOUNT":          allKeys,
+	"PTTL":             oneKey,
+	"SCARD":            oneKey,
+	"SDIFF":            allKeys,
+	"SINTER":           allKeys,
+	"SISMEMBER":        oneKey,
+	"SMEMBERS":         oneKey,
+	"SRANDMEMBER":      oneKey,
+	"SSCAN":            oneKey,
+	"STRLEN":           oneKey,
+	"SUNION":           allKeys,
+	"TTL":              oneKey,
+	"TYPE":             oneKey,
+	"ZCARD":            oneKey,
+	"ZCOUNT":           oneKey,
+	"ZLEXCOUNT":        oneKey,
+	"ZRANGE":           oneKey,
+	"ZRANGEBYLEX":      oneKey,
+	"ZRANGEBYSCORE":    oneKey,
+	"ZRANK":            oneKey,
+	"ZREVRANGE":        oneKey,
+	"ZREVRANGEBYLEX":   oneKey,
+	"ZREVRANGEBYSCORE": oneKey,
+	"ZREVRANK":         oneKey,
+	"ZSCAN":            oneKey,
+	"ZSCORE":           oneKey,
+}
+
+// writeCommands lists commands that may change the keys they're given. SORT
+// also writes a key if it has a STORE option; see writtenKeys.
+var writeCommands = map[string]keySpec{
+	"APPEND":           oneKey,
+	"BITOP":            secondKeys,
+	"BLMOVE":           twoKeys,
+	"BLPOP":            blockingKeys,
+	"BRPOP":            blockingKeys,
+	"BRPOPLPUSH":       twoKeys,
+	"BZPOPMAX":         blockingKeys,
+	"BZPOPMIN":         blockingKeys,
+	"COPY":             twoKeys,
+	"DECR":             oneKey,
+	"DECRBY":           oneKey,
+	"DEL":              allKeys,
+	"EXPIRE":           oneKey,
+	"EXPIREAT":         oneKey,
+	"GEOADD":           oneKey,
+	"GETDEL":           oneKey,
+	"GETEX":            oneKey,
+	"GETSET":           oneKey,
+	"HDEL":             oneKey,
+	"HINCRBY":          oneKey,
+	"HINCRBYFLOAT":     oneKey,
+	"HMSET":            oneKey,
+	"HSET":             oneKey,
+	"HSETNX":           oneKey,
+	"INCR":             oneKey,
+	"INCRBY":           oneKey,
+	"INCRBYFLOAT":      oneKey,
+	"LINSERT":          oneKey,
+	"LMOVE":            twoKeys,
+	"LPOP":             oneKey,
+	"LPUSH":            oneKey,
+	"LPUSHX":           oneKey,
+	"LREM":             oneKey,
+	"LSET":             oneKey,
+	"LTRIM":            oneKey,
+	"MOVE":             oneKey,
+	"MSET":             keyValues,
+	"MSETNX":           keyValues,
+	"PERSIST":          oneKey,
+	"PEXPIRE":          oneKey,
+	"PEXPIREAT":        oneKey,
+	"PFADD":            oneKey,
+	"PFMERGE":          allKeys,
+	"PSETEX":           oneKey,
+	"RENAME":           twoKeys,
+	"RENAMENX":         twoKeys,
+	"RESTORE":          oneKey,
+	"RPOP":             oneKey,
+	"RPOPLPUSH":        twoKeys,
+	"RPUSH":            oneKey,
+	"RPUSHX":           oneKey,
+	"SADD":             oneKey,
+	"SDIFFSTORE":       allKeys,
+	"SET":              oneKey,
+	"SETBIT":           oneKey,
+	"SETEX":            oneKey,
+	"SETNX":            oneKey,
+	"SETRANGE":         oneKey,
+	"SINTERSTORE":      allKeys,
+	"SMOVE":            twoKeys,
+	"SPOP":             oneKey,
+	"SREM":             oneKey,
+	"SUNIONSTORE":      allKeys,
+	"UNLINK":           allKeys,
+	"XADD":             oneKey,
+	"XDEL":             oneKey,
+	"XTRIM":            oneKey,
+	"ZADD":             oneKey,
+	"ZINCRBY":          oneKey,
+	"ZINTERSTORE":      oneKey,
+	"ZPOPMAX":          oneKey,
+	"ZPOPMIN":          oneKey,
+	"ZRANGESTORE":      twoKeys,
+	"ZREM":             oneKey,
+	"ZREMRANGEBYLEX":   oneKey,
+	"ZREMRANGEBYRANK":  oneKey,
+	"ZREMRANGEBYSCORE": oneKey,
+	"ZUNIONSTORE":      oneKey,
+}
+
+// globalWriteCommands lists commands that may change any key on the server,
+// such as scripts and transactions, whose keys can't be known in advance.
+var globalWriteCommands = map[string]bool{
+	"EVAL":     true,
+	"EVALSHA":  true,
+	"EXEC":     true,
+	"FCALL":    true,
+	"FLUSHALL": true,
+	"FLUSHDB":  true,
+	"MIGRATE":  true,
+	"SWAPDB":   true,
+}
+
+// harmlessCommands lists commands, other than the reads above, that don't
+// change any keys. Any other command that aorta doesn't know is assumed to
+// change every key on the server.
+var harmlessCommands = map[string]bool{
+	"BGREWRITEAOF": true,
+	"BGSAVE":       true,
+	"CLIENT":       true,
+	"COMMAND":      true,
+	"CONFIG":       true,
+	"DISCARD":      true,
+	"ECHO":         true,
+	"EVAL_RO":      true,
+	"EVALSHA_RO":   true,
+	"FCALL_RO":     true,
+	"HELLO":        true,
+	"INFO":         true,
+	"LATENCY":      true,
+	"MEMORY":       true,
+	"MONITOR":      true,
+	"MULTI":        true,
+	"OBJECT":       true,
+	"PING":         true,
+	"PSUBSCRIBE":   true,
+	"PUBLISH":      true,
+	"PUNSUBSCRIBE": true,
+	"ROLE":         true,
+	"SAVE":         true,
+	"SCRIPT":       true,
+	"SLOWLOG":      true,
+	"SORT_RO":      true,
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"UNWATCH":      true,
+	"WAIT":         true,
+	"WATCH":        true,
+	"XINFO":        true,
+	"XLEN":         true,
+	"XPENDING":     true,
+	"XRANGE":       true,
+	"XREAD":        true,
+	"XREVRANGE":    true,
+}
+
+// keylessReadCommands lists read-only commands that don't take keys.
+var keylessReadCommands = map[string]bool{
+	"DBSIZE": true,
+	"KEYS":   true,
+	"SCAN":   true,
+}
+
+// blockingCommands lists commands that may block the connection.
+var blockingCommands = map[string]bool{
+	"BLMOVE":     true,
+	"BLPOP":      true,
+	"BRPOP":      true,
+	"BRPOPLPUSH": true,
+	"BZPOPMAX":   true,
+	"BZPOPMIN":   true,
+	"MONITOR":    true,
+	"PSUBSCRIBE": true,
+	"SUBSCRIBE":  true,
+	"WAIT":       true,
+	"XREAD":      true,
+	"XREADGROUP": true,
+}
+
+// nondeterministicCommands lists commands whose replies differ between calls
+// even if no keys change.
+var nondeterministicCommands = map[string]bool{
+	"HRANDFIELD":  true,
+	"LASTSAVE":    true,
+	"RANDOMKEY":   true,
+	"SRANDMEMBER": true,
+	"TIME":        true,
+	"ZRANDMEMBER": true,
+}
+
+// uncacheableReason returns why the given command can't be used with CACHED
+// or CACHEDSTALE, or an empty string if it can. Commands in CacheableCommands
+// are always allowed. Otherwise only known read-only commands are allowed,
+// unless CacheUnknown is set, which allows any command that isn't known to
+// write, block, or be non-deterministic (e.g. module commands). SORT counts as
+// a write since it may have a STORE option.
+func (s *Server) uncacheableReason(name string) string {
+	_, read := readCommands[name]
+	_, write := writeCommands[name]
+	switch {
+	case s.CacheableCommands[name]:
+		return ""
+	case blockingCommands[name]:
+		return "blocking"
+	case write || globalWriteCommands[name] || name == "SORT":
+		return "write"
+	case nondeterministicCommands[name]:
+		return "non-deterministic"
+	case read || keylessReadCommands[name]:
+		return ""
+	case s.CacheUnknown:
+		return ""
+	default:
+		return "unknown"
+	}
+}
+
+// writtenKeys returns the Redis keys that the given command may change, or
+// all=true if it may change any key on the server: it's a script, a
+// transaction or FLUSHDB, or a command that aorta doesn't know (e.g. a module
+// command). Commands in CacheableCommands are assumed not to change any keys.
+func (s *Server) writtenKeys(args []string) (keys []string, all bool) {
+	name := strings.ToUpper(args[0])
+	if spec, ok := writeCommands[name]; ok {
+		return spec.keys(args), false
+	}
+	if name == "SORT" {
+		return sortStoreKeys(args), false
+	}
+	if globalWriteCommands[name] {
+		return nil, true
+	}
+	_, read := readCommands[name]
+	known := read || keylessReadCommands[name] || nondeterministicCommands[name] || harmlessCommands[name]
+	return nil, !known && !s.CacheableCommands[name]
+}
+
+// sortStoreKeys returns the destination key of a SORT command's STORE option,
+// if it has one:
+//
+//	SORT key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA] [STORE destination]
+func sortStoreKeys(args []string) []string {
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BY", "GET":
+			i++
+		case "LIMIT":
+			i += 2
+		case "STORE":
+			if i+1 < len(args) {
+				return []string{args[i+1]}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeySpecKeys(t *testing.T) {
+	tests := []struct {
+		spec keySpec
+		args []string
+		keys []string
+	}{
+		{oneKey, []string{"GET", "a"}, []string{"a"}},
+		{oneKey, []string{"HGET", "a", "field"}, []string{"a"}},
+		{allKeys, []string{"MGET", "a", "b", "c"}, []string{"a", "b", "c"}},
+		{keyValues, []string{"MSET", "a", "1", "b", "2"}, []string{"a", "b"}},
+		{twoKeys, []string{"RENAME", "a", "b"}, []string{"a", "b"}},
+		{secondKeys, []string{"BITOP", "AND", "dest", "a", "b"}, []string{"dest", "a", "b"}},
+		{oneKey, []string{"GET"}, nil},
+	}
+	for i, test := range tests {
+		got := test.spec.keys(test.args)
+		if !reflect.DeepEqual(test.keys, got) {
+			t.Errorf("tests[%d]: expected %#v, got: %#v", i, test.keys, got)
+		}
+	}
+}
+
+func TestUncacheableReason(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", time.Millisecond, time.Millisecond)
+	tests := []struct {
+		name   string
+		reason string
+	}{
+		{"GET", ""},
+		{"HGETALL", ""},
+		{"KEYS", ""},
+		{"INCR", "write"},
+		{"SET", "write"},
+		{"BLPOP", "blocking"},
+		{"BLMOVE", "blocking"},
+		{"GETDEL", "write"},
+		{"EVAL", "write"},
+		{"EXEC", "write"},
+		{"SORT", "write"},
+		{"SRANDMEMBER", "non-deterministic"},
+		{"TIME", "non-deterministic"},
+		{"JSON.GET", "unknown"},
+	}
+	for i, test := range tests {
+		if got := proxy.uncacheableReason(test.name); got != test.reason {
+			t.Errorf("tests[%d]: expected %#v for %s, got: %#v", i, test.reason, test.name, got)
+		}
+	}
+
+	// Operators can allow extra commands
+	proxy.CacheableCommands = map[string]bool{"JSON.GET": true, "SRANDMEMBER": true}
+	for _, name := range []string{"JSON.GET", "SRANDMEMBER"} {
+		if got := proxy.uncacheableReason(name); got != "" {
+			t.Errorf("expected %s to be allowed, got: %#v", name, got)
+		}
+	}
+	proxy.CacheableCommands = nil
+	proxy.CacheUnknown = true
+	if got := proxy.uncacheableReason("JSON.GET"); got != "" {
+		t.Errorf("expected unknown commands to be allowed, got: %#v", got)
+	}
+	if got := proxy.uncacheableReason("INCR"); got != "write" {
+		t.Errorf("expected writes to be rejected, got: %#v", got)
+	}
+}
+
+func TestWrittenKeys(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", time.Millisecond, time.Millisecond)
+	proxy.CacheableCommands = map[string]bool{"JSON.GET": true}
+	tests := []struct {
+		args []string
+		keys []string
+		all  bool
+	}{
+		{[]string{"GET", "a"}, nil, false},
+		{[]string{"PING"}, nil, false},
+		{[]string{"JSON.GET", "a"}, nil, false},
+		{[]string{"set", "a", "1"}, []string{"a"}, false},
+		{[]string{"BLPOP", "a", "b", "0"}, []string{"a", "b"}, false},
+		{[]string{"LMOVE", "a", "b", "LEFT", "RIGHT"}, []string{"a", "b"}, false},
+		{[]string{"SORT", "a", "BY", "store", "LIMIT", "0", "10"}, nil, false},
+		{[]string{"SORT", "a", "GET", "#", "STORE", "b"}, []string{"b"}, false},
+		{[]string{"EVAL", "return 1", "0"}, nil, true},
+		{[]string{"EXEC"}, nil, true},
+		{[]string{"SWAPDB", "0", "1"}, nil, true},
+		{[]string{"JSON.SET", "a", ".", "1"}, nil, true},
+	}
+	for i, test := range tests {
+		keys, all := proxy.writtenKeys(test.args)
+		if !reflect.DeepEqual(test.keys, keys) || test.all != all {
+			t.Errorf("tests[%d]: expected %#v, %v, got: %#v, %v", i, test.keys, test.all, keys, all)
+		}
+	}
+}
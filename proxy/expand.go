@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stvp/aorta/cache"
+	"github.com/stvp/aorta/redis"
+	"github.com/stvp/resp"
+	. "github.com/stvp/stvp/log/helpers"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expandedCommands lists multi-key read commands that CACHED splits into one
+// cache entry per key (or per field, for HMGET), along with the number of
+// leading arguments shared by every entry. MGET a b is cached as MGET a and
+// MGET b, so that later MGETs of overlapping keys share cached replies.
+var expandedCommands = map[string]int{
+	"MGET":  1,
+	"HMGET": 2,
+}
+
+// expandedDo is like cachedDo for the commands in expandedCommands. Each key
+// or field is looked up in the cache separately, and the missing ones are
+// fetched from the server with a single command. The reply is reassembled in
+// the original order. Unlike cachedDo, simultaneous misses for the same key
+// aren't combined into a single cache fill. Each entry is tagged like
+// cachedDo's, with the given client tags. In a peer group, entries owned by
+// other peers are asked for from their owners (see fillExpanded).
+func (s *Server) expandedDo(ctx context.Context, name string, args []string, maxAge time.Time, conn *redis.ServerConn, tags []string) (resp.Object, bool, error) {
+	// Use the upper-case command name so that entries are shared regardless of
+	// the client's capitalization
+	n := expandedCommands[name]
+	shared := append([]string{name}, args[1:n]...)
+	items := args[n:]
+
+	parts := make([]resp.Object, len(items))
+	var missing []string
+	positions := map[string][]int{}
+	for i, item := range items {
+		key := s.expandedCacheKey(shared, item, conn)
+		if obj, ok := s.Cache.Get(key, maxAge); ok {
+			parts[i] = obj
+			continue
+		}
+		if _, ok := positions[item]; !ok {
+			missing = append(missing, item)
+		}
+		positions[item] = append(positions[item], i)
+	}
+
+	if len(missing) > 0 {
+		filled, response, err := s.fillExpanded(ctx, shared, missing, time.Since(maxAge), conn)
+		if err == context.DeadlineExceeded {
+			err = redis.ErrTimeout
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if filled == nil {
+			// Errors (e.g. WRONGTYPE) are returned as-is and not cached
+			return response, false, nil
+		}
+
+		for _, item := range missing {
+			partArgs := expandedArgs(shared, item)
+			key := s.cacheKey(resp.NewCommand(partArgs...), conn)
+			s.Cache.Set(key, cache.TaggedObject{Object: filled[item], Tags: s.readTags(partArgs, conn, tags)})
+			for _, position := range positions[item] {
+				parts[position] = filled[item]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(parts))
+	for _, part := range parts {
+		buf.Write(part.Raw())
+	}
+	return resp.Array(buf.Bytes()), len(missing) == 0, nil
+}
+
+// fillExpanded fetches the entries for the given items, whose cached replies
+// may be up to maxAge old if they come from a peer. In a peer group, each item
+// owned by another peer is asked for from its owner, and the rest, along with
+// any whose owner can't be reached, are fetched from the Redis server with a
+// single command. It returns the reply for each item, wrapped in a
+// cache.ExpiringObject if it expires, or a nil map and the Redis server's reply
+// if that isn't an array of them.
+func (s *Server) fillExpanded(ctx context.Context, shared, items []string, maxAge time.Duration, conn *redis.ServerConn) (map[string]resp.Object, resp.Object, error) {
+	filled := make(map[string]resp.Object, len(items))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var peerErr error
+	for _, item := range items {
+		command := resp.NewCommand(expandedArgs(shared, item)...)
+		owner, ok := s.peerOwner(ctx, s.cacheKey(command, conn))
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(item, owner string, command resp.Command) {
+			defer wg.Done()
+			response, err := s.Peers.fetch(ctx, owner, maxAge, command, conn)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				filled[item] = response
+			} else if _, ok := err.(resp.Error); ok {
+				peerErr = err
+			} else if ctx.Err() != nil {
+				peerErr = ctx.Err()
+			} else {
+				DEBUG("Filling cached reply locally: %s", err.Error())
+			}
+		}(item, owner, command)
+	}
+	wg.Wait()
+	if peerErr != nil {
+		return nil, nil, peerErr
+	}
+
+	var local []string
+	for _, item := range items {
+		if _, ok := filled[item]; !ok {
+			local = append(local, item)
+		}
+	}
+	if len(local) == 0 {
+		return filled, nil, nil
+	}
+
+	command := resp.NewCommand(append(shared, local...)...)
+	var ttlKeys []string
+	if s.KeyTTL {
+		ttlKeys = expandedKeys(shared, local)
+	}
+	response, expires, err := s.doWithTTLs(ctx, command, ttlKeys, conn)
+	if s.Mirror != nil && ctx.Err() == nil {
+		s.Mirror.Send(conn.Address(), command, response, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	elements, ok := redis.ArrayElements(response)
+	if !ok || len(elements) != len(local) {
+		return nil, response, nil
+	}
+	for i, item := range local {
+		part := elements[i]
+		if at, ok := expires[readCommands[shared[0]].keys(expandedArgs(shared, item))[0]]; ok {
+			part = cache.ExpiringObject{Object: part, Expires: at}
+		}
+		filled[item] = part
+	}
+	return filled, nil, nil
+}
+
+// cachedKeys returns the cache keys that a cached command's reply is stored
+// under. If expand is set, the commands in expandedCommands have one key per
+// key or field, as in expandedDo. Other commands have a single key.
+func (s *Server) cachedKeys(args []string, conn *redis.ServerConn, expand bool) []string {
+	name := strings.ToUpper(args[0])
+	if n, ok := expandedCommands[name]; expand && ok && len(args) > n {
+		shared := append([]string{name}, args[1:n]...)
+		keys := make([]string, 0, len(args)-n)
+		for _, item := range args[n:] {
+			keys = append(keys, s.expandedCacheKey(shared, item, conn))
+		}
+		return keys
+	}
+	return []string{s.cacheKey(resp.NewCommand(args...), conn)}
+}
+
+// expandedCacheKey returns the cache key for a single key or field of one of
+// the commands in expandedCommands.
+func (s *Server) expandedCacheKey(shared []string, item string, conn *redis.ServerConn) string {
+	return s.cacheKey(resp.NewCommand(expandedArgs(shared, item)...), conn)
+}
+
+func expandedArgs(shared []string, item string) []string {
+	return append(append([]string{}, shared...), item)
+}
+
+// expandedKeys returns the distinct Redis keys read by the entries for the
+// given items.
+func expandedKeys(shared []string, items []string) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, item := range items {
+		for _, key := range readCommands[shared[0]].keys(expandedArgs(shared, item)) {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
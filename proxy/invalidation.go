@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"github.com/stvp/aorta/redis"
+	. "github.com/stvp/stvp/log/helpers"
+	"time"
+)
+
+// watch starts listening for key changes on the given Redis server, if the
+// Server isn't already, so that cached replies are invalidated as soon as the
+// keys they depend on change, even if the change wasn't made through aorta.
+func (s *Server) watch(backend string, conn *redis.ServerConn) {
+	s.invalidatorsMutex.Lock()
+	defer s.invalidatorsMutex.Unlock()
+
+	if s.invalidators == nil {
+		s.invalidators = make(map[string]*redis.InvalidationConn)
+	}
+	if _, ok := s.invalidators[backend]; ok {
+		return
+	}
+
+	invalidator := redis.NewInvalidationConn(conn.Address(), conn.Password(), s.serverTimeouts)
+	s.invalidators[backend] = invalidator
+	go s.runInvalidator(backend, invalidator)
+}
+
+func (s *Server) runInvalidator(backend string, invalidator *redis.InvalidationConn) {
+	for {
+		err := invalidator.Listen(func(keys []string) {
+			if keys == nil {
+				s.Cache.InvalidateTag(backendTag(backend))
+				return
+			}
+			for _, key := range keys {
+				s.Cache.InvalidateTag(keyTag(backend, key))
+			}
+		})
+		if invalidator.Closed() {
+			return
+		}
+
+		// Changes may have been missed while disconnected
+		s.Cache.InvalidateTag(backendTag(backend))
+		DEBUG("Invalidation connection failed: %s", err.Error())
+		time.Sleep(time.Second)
+	}
+}
+
+// unwatch stops listening for key changes on the given expired server
+// connection's Redis server, unless another connection in the pool still uses
+// it.
+func (s *Server) unwatch(conn *redis.ServerConn) {
+	backend := s.backendKey(conn)
+	for _, other := range s.Pool.Conns() {
+		if s.backendKey(other) == backend {
+			return
+		}
+	}
+
+	s.invalidatorsMutex.Lock()
+	defer s.invalidatorsMutex.Unlock()
+	if invalidator, ok := s.invalidators[backend]; ok {
+		invalidator.Close()
+		delete(s.invalidators, backend)
+	}
+}
+
+func (s *Server) closeInvalidators() {
+	s.invalidatorsMutex.Lock()
+	defer s.invalidatorsMutex.Unlock()
+
+	for backend, invalidator := range s.invalidators {
+		invalidator.Close()
+		delete(s.invalidators, backend)
+	}
+}
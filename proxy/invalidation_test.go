@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnwatch(t *testing.T) {
+	server := NewServer("", "", time.Second, 10*time.Millisecond)
+	server.Invalidation = true
+	defer server.Close()
+
+	now := time.Now()
+	expired := server.Pool.GetFailover([]string{"127.0.0.1:1"}, "pw", server.serverTimeouts)
+	shared := server.Pool.GetFailover([]string{"127.0.0.1:2"}, "pw", server.serverTimeouts)
+	sharedFailover := server.Pool.GetFailover([]string{"127.0.0.1:2", "127.0.0.1:3"}, "pw", server.serverTimeouts)
+	server.watch(server.backendKey(expired), expired)
+	server.watch(server.backendKey(shared), shared)
+	expired.LastUsed = now.Add(-time.Hour)
+	shared.LastUsed = now.Add(-time.Hour)
+	sharedFailover.LastUsed = now
+
+	server.invalidatorsMutex.Lock()
+	invalidator := server.invalidators[server.backendKey(expired)]
+	server.invalidatorsMutex.Unlock()
+
+	if n := server.Pool.Expire(now.Add(-time.Minute)); n != 2 {
+		t.Fatalf("expected to expire 2 connections, expired %d", n)
+	}
+	if !invalidator.Closed() {
+		t.Error("expected the expired server's invalidator to be closed")
+	}
+
+	// The other server is still used by a connection with failover addresses
+	server.invalidatorsMutex.Lock()
+	defer server.invalidatorsMutex.Unlock()
+	if _, ok := server.invalidators[server.backendKey(expired)]; ok {
+		t.Error("expected the expired server's invalidator to be removed")
+	}
+	if _, ok := server.invalidators[server.backendKey(shared)]; !ok {
+		t.Error("expected the shared server's invalidator to be kept")
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stvp/aorta/redis"
+	"github.com/stvp/resp"
+	"strconv"
+	"strings"
+)
+
+// digestKeySize is the size of random digest keys. See Server.DigestKey.
+const digestKeySize = 32
+
+// backendKey identifies the Redis server that a ServerConn is connected to.
+// It's made of the server's address and a digest of its password, separated by
+// a NUL byte, so that the password itself isn't kept in cache keys or tags.
+func (s *Server) backendKey(conn *redis.ServerConn) string {
+	return conn.Address() + "\x00" + s.passwordDigest(conn.Password())
+}
+
+// cacheKey returns the key used to cache replies to the given command from the
+// given server.
+func (s *Server) cacheKey(command resp.Command, conn *redis.ServerConn) string {
+	args, _ := command.Slices()
+	return encodeCacheKey(conn.Address(), s.passwordDigest(conn.Password()), args, s.HashKeys)
+}
+
+// passwordDigest returns the HMAC-SHA256 of the given password with the
+// Server's DigestKey. Unlike a plain hash, the digest can't be checked against
+// guessed passwords without the key, so it's safe to keep in cache keys, which
+// may be saved to disk (see cache.Cache.SaveSnapshot).
+func (s *Server) passwordDigest(password string) string {
+	mac := hmac.New(sha256.New, s.DigestKey)
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewDigestKey returns a random key for Server.DigestKey.
+func NewDigestKey() []byte {
+	key := make([]byte, digestKeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// PeerDigestKey returns the Server.DigestKey for a peer group with the given
+// proxy password. Peers need the same key to agree on cache keys, and their
+// shared password is a secret that they all already have.
+func PeerDigestKey(password string) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte("aorta digest key"))
+	return mac.Sum(nil)
+}
+
+// encodeCacheKey writes each of the server's address, its password digest, and
+// the command's arguments with a length prefix ("3:GET3:foo") so that distinct
+// commands or servers never produce the same key. If hash is true, the SHA-256
+// sum of the encoded key is returned instead.
+func encodeCacheKey(address, digest string, args [][]byte, hash bool) string {
+	var buf bytes.Buffer
+	writeField(&buf, []byte(address))
+	writeField(&buf, []byte(digest))
+	for _, arg := range args {
+		writeField(&buf, arg)
+	}
+	if hash {
+		sum := sha256.Sum256(buf.Bytes())
+		return string(sum[:])
+	}
+	return buf.String()
+}
+
+func writeField(buf *bytes.Buffer, field []byte) {
+	buf.WriteString(strconv.Itoa(len(field)))
+	buf.WriteByte(':')
+	buf.Write(field)
+}
+
+// decodeCacheKey returns the server address and command arguments of a key
+// made by encodeCacheKey, or false if the key can't be decoded (e.g. because
+// it's hashed).
+func decodeCacheKey(key string) (address string, args []string, ok bool) {
+	var fields []string
+	for len(key) > 0 {
+		sep := strings.IndexByte(key, ':')
+		if sep < 1 {
+			return "", nil, false
+		}
+		n, err := strconv.Atoi(key[:sep])
+		if err != nil || n < 0 || n > len(key)-sep-1 {
+			return "", nil, false
+		}
+		fields = append(fields, key[sep+1:sep+1+n])
+		key = key[sep+1+n:]
+	}
+	if len(fields) < 3 {
+		return "", nil, false
+	}
+	return fields[0], fields[2:], true
+}
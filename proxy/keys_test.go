@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func byteArgs(args []string) [][]byte {
+	b := make([][]byte, len(args))
+	for i, arg := range args {
+		b[i] = []byte(arg)
+	}
+	return b
+}
+
+func TestEncodeCacheKey(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", 0, 0)
+	digest := proxy.passwordDigest("secret")
+	tests := [][2][]string{
+		{{"GET", "abc"}, {"GETa", "bc"}},
+		{{"GET", "ab", "c"}, {"GET", "a", "bc"}},
+		{{"GET", ""}, {"GET"}},
+		{{"GET", "3:foo"}, {"GET", "3", "foo"}},
+	}
+	for i, test := range tests {
+		for _, hash := range []bool{false, true} {
+			a := encodeCacheKey("host:6379", digest, byteArgs(test[0]), hash)
+			b := encodeCacheKey("host:6379", digest, byteArgs(test[1]), hash)
+			if a == b {
+				t.Errorf("tests[%d]: %#v and %#v have the same key (hash: %v)", i, test[0], test[1], hash)
+			}
+		}
+	}
+
+	// Servers and passwords are part of the key
+	args := byteArgs([]string{"GET", "foo"})
+	keys := []string{
+		encodeCacheKey("host:6379", digest, args, false),
+		encodeCacheKey("host:6380", digest, args, false),
+		encodeCacheKey("host:6379", proxy.passwordDigest("other"), args, false),
+	}
+	if keys[0] == keys[1] || keys[0] == keys[2] {
+		t.Errorf("expected distinct keys, got: %#v", keys)
+	}
+	if strings.Contains(keys[0], "secret") {
+		t.Errorf("key contains the plaintext password: %#v", keys[0])
+	}
+
+	if key := encodeCacheKey("host:6379", digest, args, true); len(key) != 32 {
+		t.Errorf("expected a 32-byte hashed key, got %d bytes", len(key))
+	}
+}
+
+func TestPasswordDigest(t *testing.T) {
+	a := NewServer("0.0.0.0:12001", "pw", 0, 0)
+	b := NewServer("0.0.0.0:12002", "pw", 0, 0)
+	if a.passwordDigest("secret") != a.passwordDigest("secret") {
+		t.Error("expected the same digest for the same password")
+	}
+	if a.passwordDigest("secret") == a.passwordDigest("other") {
+		t.Error("expected different digests for different passwords")
+	}
+
+	// Each Server has its own key unless it's given one
+	if a.passwordDigest("secret") == b.passwordDigest("secret") {
+		t.Error("expected Servers with random keys to have different digests")
+	}
+	a.DigestKey = PeerDigestKey("pw")
+	b.DigestKey = PeerDigestKey("pw")
+	if a.passwordDigest("secret") != b.passwordDigest("secret") {
+		t.Error("expected peers to have the same digests")
+	}
+}
+
+func TestDecodeCacheKey(t *testing.T) {
+	args := []string{"HMGET", "user:1", "3:name"}
+	address, got, ok := decodeCacheKey(encodeCacheKey("host:6379", "digest", byteArgs(args), false))
+	if !ok || address != "host:6379" || !reflect.DeepEqual(got, args) {
+		t.Errorf("expected %#v on host:6379, got: %#v on %#v (%v)", args, got, address, ok)
+	}
+	for _, bad := range []string{"", "4:host", "9:host", "x:host6:digest3:GET", "4:host6:digest3:GE"} {
+		if _, _, ok := decodeCacheKey(bad); ok {
+			t.Errorf("expected %q not to decode", bad)
+		}
+	}
+}
+
+func TestEncodeCacheKey_Fuzz(t *testing.T) {
+	// Distinct commands never have the same key
+	distinct := func(addressA, addressB string, a, b []string) bool {
+		same := addressA == addressB && reflect.DeepEqual(byteArgs(a), byteArgs(b))
+		keyA := encodeCacheKey(addressA, "", byteArgs(a), false)
+		keyB := encodeCacheKey(addressB, "", byteArgs(b), false)
+		return same == (keyA == keyB)
+	}
+	if err := quick.Check(distinct, nil); err != nil {
+		t.Error(err)
+	}
+
+	// Splitting the same bytes into different arguments gives different keys
+	split := func(s string, i, j uint8) bool {
+		x, y := int(i)%(len(s)+1), int(j)%(len(s)+1)
+		a := []string{s[:x], s[x:]}
+		b := []string{s[:y], s[y:]}
+		keyA := encodeCacheKey("host:6379", "", byteArgs(a), false)
+		keyB := encodeCacheKey("host:6379", "", byteArgs(b), false)
+		return (x == y) == (keyA == keyB)
+	}
+	if err := quick.Check(split, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stvp/aorta/redis"
+	"github.com/stvp/resp"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Mirror copies proxied commands to a shadow Redis server in the
+// background. Mirroring is best-effort: if the shadow server can't keep up,
+// commands are dropped rather than slowing down the primary path. If Compare
+// is set, the shadow server's replies are compared with the primary server's
+// replies and any differences are written to the diff log.
+type Mirror struct {
+	// Source limits mirroring to commands sent to the primary server with this
+	// address. If empty, commands sent to any server are mirrored.
+	Source  string
+	Compare bool
+
+	// Stats. Mirrored counts commands that the shadow server replied to, and
+	// Errors counts commands that couldn't be sent or got no reply.
+	Mirrored int64
+	Errors   int64
+	Dropped  int64
+	Diffs    int64
+
+	conn    *redis.ServerConn
+	diffLog io.Writer
+	queue   chan mirroredCommand
+	pending sync.WaitGroup // queued commands that haven't been sent yet
+	done    chan bool
+}
+
+type mirroredCommand struct {
+	command  resp.Command
+	response []byte
+}
+
+// NewMirror returns a Mirror that sends commands to the shadow Redis server at
+// the given address. Up to queueSize commands are buffered while waiting to be
+// sent. Differences are written to diffLog, which may be nil if Compare isn't
+// used.
+func NewMirror(address, password string, timeouts redis.Timeouts, queueSize int, diffLog io.Writer) *Mirror {
+	m := &Mirror{
+		conn:    redis.NewFailoverServerConn([]string{address}, password, timeouts),
+		diffLog: diffLog,
+		queue:   make(chan mirroredCommand, queueSize),
+		done:    make(chan bool),
+	}
+	go m.run()
+	return m
+}
+
+// Address returns the address of the shadow server.
+func (m *Mirror) Address() string {
+	return m.conn.Address()
+}
+
+// Send queues a command, along with the primary server's reply, to be sent to
+// the shadow server. It never blocks; if the queue is full, the command is
+// dropped.
+func (m *Mirror) Send(source string, command resp.Command, response resp.Object, err error) {
+	if len(m.Source) > 0 && m.Source != source {
+		return
+	}
+
+	mc := mirroredCommand{command: command}
+	if m.Compare {
+		mc.response = replyBytes(response, err)
+	}
+
+	m.pending.Add(1)
+	select {
+	case m.queue <- mc:
+	default:
+		m.pending.Done()
+		atomic.AddInt64(&m.Dropped, 1)
+	}
+}
+
+// drain waits until every queued command has been sent.
+func (m *Mirror) drain() {
+	m.pending.Wait()
+}
+
+// Close stops mirroring and closes the connection to the shadow server.
+// Commands that are still queued are discarded.
+func (m *Mirror) Close() {
+	close(m.done)
+	m.conn.Close()
+}
+
+func (m *Mirror) run() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case mc := <-m.queue:
+			m.send(mc)
+			m.pending.Done()
+		}
+	}
+}
+
+func (m *Mirror) send(mc mirroredCommand) {
+	response, err := m.conn.Do(mc.command)
+	if _, ok := err.(resp.Error); err != nil && !ok {
+		// The shadow server didn't reply, so there's nothing to compare
+		atomic.AddInt64(&m.Errors, 1)
+		return
+	}
+	atomic.AddInt64(&m.Mirrored, 1)
+	if !m.Compare {
+		return
+	}
+	shadowResponse := replyBytes(response, err)
+	if !bytes.Equal(mc.response, shadowResponse) {
+		atomic.AddInt64(&m.Diffs, 1)
+		m.logDiff(mc.command, mc.response, shadowResponse)
+	}
+}
+
+func (m *Mirror) logDiff(command resp.Command, primary, shadow []byte) {
+	if m.diffLog == nil {
+		return
+	}
+	args, _ := command.Strings()
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = fmt.Sprintf("%q", arg)
+	}
+	fmt.Fprintf(m.diffLog, "%s\tcommand:%s\tprimary:%q\tshadow:%q\n", time.Now().UTC().Format(time.RFC3339), strings.Join(quoted, " "), primary, shadow)
+}
+
+// replyBytes returns the raw RESP reply for a response. Connection errors
+// aren't RESP objects, so they're converted to RESP errors.
+func replyBytes(response resp.Object, err error) []byte {
+	if e, ok := err.(resp.Error); ok {
+		return e.Raw()
+	} else if err != nil {
+		return resp.NewError(err.Error())
+	}
+	return response.Raw()
+}
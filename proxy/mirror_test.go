@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"github.com/garyburd/redigo/redis"
+	r "github.com/stvp/aorta/redis"
+	"github.com/stvp/resp"
+	"github.com/stvp/tempredis"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A lockedBuffer is a bytes.Buffer that's safe to write to from the mirror's
+// goroutine while a test reads it.
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestMirror(t *testing.T) {
+	withProxyAndServers(2, func(proxy *Server, servers []*tempredis.Server) {
+		primary := servers[0].Config
+		shadow := servers[1].Config
+
+		var diffLog lockedBuffer
+		mirror := NewMirror(shadow.Address(), shadow.Password(), r.NewTimeouts(10*time.Millisecond), 10, &diffLog)
+		mirror.Compare = true
+		defer mirror.Close()
+		proxy.Mirror = mirror
+
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", primary.Bind(), primary.Port(), primary.Password())
+		_, err := conn.Do("SET", "foo", "bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirror.drain()
+
+		// Writes are copied to the shadow server
+		shadowConn := r.NewServerConn(shadow.Address(), shadow.Password(), 10*time.Millisecond)
+		response, err := shadowConn.Do(resp.NewCommand("GET", "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.NewBulkString("bar"), response) {
+			t.Errorf("expected shadow server to have foo=bar, got: %#v", response)
+		}
+		if diffLog.String() != "" {
+			t.Errorf("expected no diffs, got: %s", diffLog.String())
+		}
+
+		// Differing replies are logged
+		shadowConn.Do(resp.NewCommand("SET", "foo", "baz"))
+		got, err := redis.String(conn.Do("GET", "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "bar" {
+			t.Errorf("expected primary reply, got: %#v", got)
+		}
+		mirror.drain()
+		if diffs := atomic.LoadInt64(&mirror.Diffs); diffs != 1 {
+			t.Errorf("expected 1 diff, got: %d", diffs)
+		}
+		if errors := atomic.LoadInt64(&mirror.Errors); errors != 0 {
+			t.Errorf("expected no errors, got: %d", errors)
+		}
+		if !strings.Contains(diffLog.String(), `command:"GET" "foo"`) {
+			t.Errorf("diff log is missing the command: %s", diffLog.String())
+		}
+	})
+}
+
+func TestMirror_Source(t *testing.T) {
+	mirror := NewMirror("0.0.0.0:9999", "", r.NewTimeouts(time.Millisecond), 1, nil)
+	defer mirror.Close()
+	mirror.Source = "0.0.0.0:22000"
+
+	mirror.Send("0.0.0.0:22001", resp.NewCommand("PING"), resp.PONG, nil)
+	if len(mirror.queue) != 0 {
+		t.Errorf("commands for other servers shouldn't be mirrored")
+	}
+}
+
+func TestMirror_Errors(t *testing.T) {
+	var diffLog lockedBuffer
+	mirror := NewMirror("127.0.0.1:1", "", r.NewTimeouts(10*time.Millisecond), 1, &diffLog)
+	defer mirror.Close()
+	mirror.Compare = true
+
+	// Commands that the shadow server doesn't reply to are errors, not diffs
+	mirror.Send("0.0.0.0:22000", resp.NewCommand("PING"), resp.PONG, nil)
+	mirror.drain()
+	if mirrored, errors := atomic.LoadInt64(&mirror.Mirrored), atomic.LoadInt64(&mirror.Errors); mirrored != 0 || errors != 1 {
+		t.Errorf("expected 0 mirrored and 1 error, got: %d and %d", mirrored, errors)
+	}
+	if diffs := atomic.LoadInt64(&mirror.Diffs); diffs != 0 || diffLog.String() != "" {
+		t.Errorf("expected no diffs, got: %d, %s", diffs, diffLog.String())
+	}
+}
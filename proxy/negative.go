@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"github.com/stvp/resp"
+	"strings"
+)
+
+// IsNegativeReply returns true for nil replies and error replies. It's meant
+// for cache.Cache.IsNegative, so that replies for missing keys and cached
+// errors (see Server.NegativeErrors) can have their own max age.
+func IsNegativeReply(obj resp.Object) bool {
+	raw := string(obj.Raw())
+	return raw == "$-1\r\n" || raw == "*-1\r\n" || strings.HasPrefix(raw, "-")
+}
+
+// negativeError returns true if the given error is a Redis error reply whose
+// class (e.g. WRONGTYPE) is listed in NegativeErrors.
+func (s *Server) negativeError(err error) bool {
+	e, ok := err.(resp.Error)
+	if !ok || len(s.NegativeErrors) == 0 {
+		return false
+	}
+	return s.NegativeErrors[errorClass(e)]
+}
+
+// errorClass returns the first word of the given error reply, e.g. WRONGTYPE
+// or ERR.
+func errorClass(e resp.Error) string {
+	message := strings.TrimPrefix(strings.TrimRight(string(e.Raw()), "\r\n"), "-")
+	if i := strings.IndexByte(message, ' '); i >= 0 {
+		message = message[:i]
+	}
+	return message
+}
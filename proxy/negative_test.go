@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/stvp/resp"
+	"testing"
+)
+
+func TestIsNegativeReply(t *testing.T) {
+	tests := []struct {
+		reply    resp.Object
+		negative bool
+	}{
+		{resp.String("$-1\r\n"), true},
+		{resp.Array("*-1\r\n"), true},
+		{resp.NewError("WRONGTYPE Operation against a key holding the wrong kind of value"), true},
+		{resp.NewBulkString(""), false},
+		{resp.Array("*0\r\n"), false},
+		{resp.Integer(":-1\r\n"), false},
+	}
+	for i, test := range tests {
+		if got := IsNegativeReply(test.reply); got != test.negative {
+			t.Errorf("tests[%d]: expected %v, got %v", i, test.negative, got)
+		}
+	}
+}
+
+func TestNegativeError(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", 0, 0)
+	wrongType := resp.NewError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	if proxy.negativeError(wrongType) {
+		t.Error("expected errors not to be cached by default")
+	}
+
+	proxy.NegativeErrors = map[string]bool{"WRONGTYPE": true}
+	tests := []struct {
+		err      error
+		negative bool
+	}{
+		{wrongType, true},
+		{resp.NewError("WRONGTYPE"), true},
+		{resp.NewError("ERR unknown command"), false},
+		{errors.New("WRONGTYPE but not a Redis error"), false},
+		{nil, false},
+	}
+	for i, test := range tests {
+		if got := proxy.negativeError(test.err); got != test.negative {
+			t.Errorf("tests[%d]: expected %v, got %v", i, test.negative, got)
+		}
+	}
+}
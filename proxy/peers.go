@@ -0,0 +1,348 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stvp/aorta/cache"
+	"github.com/stvp/aorta/redis"
+	"github.com/stvp/resp"
+	. "github.com/stvp/stvp/log/helpers"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// peerReplicas is the number of points each peer has on the hash ring. More
+// points spread cache keys more evenly between peers.
+const peerReplicas = 64
+
+var errPeerReply = errors.New("aorta: invalid reply from peer")
+
+// Peers is a group of aorta instances that share their cached replies. Each
+// cache key is owned by one peer, chosen by consistent hashing, and the other
+// peers ask the owner for the reply instead of fetching it from the Redis
+// server themselves, so that the group only fills each reply once. Peers talk
+// to each other over the same protocol as clients, using the internal PEER
+// command (see Server.handlePeer). If the owner can't be reached, the reply is
+// fetched from the Redis server as usual. Writes invalidate cached replies on
+// every peer, since any of them may have cached a reply that the write changed
+// (see Server.handlePeerInvalidate). Cache keys include a digest of the
+// Redis password, so every peer's Server needs the same DigestKey (see
+// PeerDigestKey) for the peers to agree on the owner of each key.
+type Peers struct {
+	// Self is the address that the other peers use to reach this instance.
+	Self string
+
+	// Stats
+	Requests      int64 // Replies requested from other peers
+	Invalidations int64 // Invalidations sent to other peers
+	Errors        int64 // Requests and invalidations that failed
+	Served        int64 // Replies requested by other peers
+
+	password string
+	timeouts redis.Timeouts
+	pool     *redis.ServerConnPool
+
+	mutex     sync.RWMutex
+	addresses []string
+	hashes    []uint32
+	owners    map[uint32]string
+}
+
+// NewPeers returns an empty peer group for the instance at the given address.
+// Peers authenticate with each other using the given password, which should be
+// the proxy password shared by all of the peers.
+func NewPeers(self, password string, timeouts redis.Timeouts) *Peers {
+	return &Peers{
+		Self:     self,
+		password: password,
+		timeouts: timeouts,
+		pool:     redis.NewServerConnPool(),
+		owners:   map[uint32]string{},
+	}
+}
+
+// Set replaces the addresses of the peers in the group, which should include
+// Self. Every peer must be given the same addresses so that they agree on the
+// owner of each cache key.
+func (p *Peers) Set(addresses ...string) {
+	hashes := make([]uint32, 0, len(addresses)*peerReplicas)
+	owners := make(map[uint32]string, len(addresses)*peerReplicas)
+	for _, address := range addresses {
+		for i := 0; i < peerReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + address))
+			hashes = append(hashes, hash)
+			owners[hash] = address
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	p.mutex.Lock()
+	p.addresses = addresses
+	p.hashes = hashes
+	p.owners = owners
+	p.mutex.Unlock()
+}
+
+// Owner returns the address of the peer that owns the given cache key, or Self
+// if the group is empty.
+func (p *Peers) Owner(key string) string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if len(p.hashes) == 0 {
+		return p.Self
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(p.hashes), func(i int) bool { return p.hashes[i] >= hash })
+	if i == len(p.hashes) {
+		i = 0
+	}
+	return p.owners[p.hashes[i]]
+}
+
+// fetch asks the given peer for the reply to a command sent to the given Redis
+// server, allowing cached replies up to maxAge old. The reply is wrapped in a
+// cache.ExpiringObject so that it isn't cached past maxAge from when the owner
+// cached it. If the owner replies with a Redis error, it's returned as a
+// resp.Error; any other error means the owner couldn't be reached.
+func (p *Peers) fetch(ctx context.Context, owner string, maxAge time.Duration, command resp.Command, conn *redis.ServerConn) (resp.Object, error) {
+	atomic.AddInt64(&p.Requests, 1)
+	args, err := command.Strings()
+	if err != nil {
+		return nil, err
+	}
+	args = append([]string{"PEER", strconv.FormatInt(int64(maxAge/time.Millisecond), 10)}, args...)
+
+	// The proxy always requires AUTH, even with an empty password, so it's
+	// sent with every request instead of only when the connection is opened.
+	peer := p.pool.GetFailover([]string{owner}, "", p.timeouts)
+	responses, err := peer.DoPipelineContext(ctx, resp.NewCommand("AUTH", p.password), proxyCommand(conn), resp.NewCommand(args...))
+	if err == nil {
+		if e, ok := responses[0].(resp.Error); ok {
+			err = e
+		} else if e, ok := responses[1].(resp.Error); ok {
+			err = e
+		} else if e, ok := responses[2].(resp.Error); ok {
+			return nil, e
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&p.Errors, 1)
+		return nil, fmt.Errorf("aorta: peer %s: %s", owner, err.Error())
+	}
+
+	response, err := parsePeerReply(responses[2], maxAge)
+	if err != nil {
+		atomic.AddInt64(&p.Errors, 1)
+	}
+	return response, err
+}
+
+// invalidate asks every other peer to remove its cached replies with any of
+// the given tags, and waits for them to reply. Peers that can't be reached are
+// logged and counted as errors; they may keep serving the invalidated replies
+// until they expire.
+func (p *Peers) invalidate(ctx context.Context, tags []string) {
+	p.mutex.RLock()
+	addresses := p.addresses
+	p.mutex.RUnlock()
+
+	command := resp.NewCommand(append([]string{"PEERINVALIDATE"}, tags...)...)
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		if address == p.Self {
+			continue
+		}
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			atomic.AddInt64(&p.Invalidations, 1)
+			peer := p.pool.GetFailover([]string{address}, "", p.timeouts)
+			responses, err := peer.DoPipelineContext(ctx, resp.NewCommand("AUTH", p.password), command)
+			if err == nil {
+				if e, ok := responses[0].(resp.Error); ok {
+					err = e
+				} else if e, ok := responses[1].(resp.Error); ok {
+					err = e
+				}
+			}
+			if err != nil {
+				atomic.AddInt64(&p.Errors, 1)
+				WARN("Invalidating cached replies on peer %s: %s", address, err.Error())
+			}
+		}(address)
+	}
+	wg.Wait()
+}
+
+// proxyCommand returns the PROXY command that selects the given Redis server.
+func proxyCommand(conn *redis.ServerConn) resp.Command {
+	args := []string{"PROXY"}
+	for i, address := range conn.Addresses() {
+		sep := strings.LastIndex(address, ":")
+		args = append(args, address[:sep], address[sep+1:])
+		if i == 0 {
+			args = append(args, conn.Password())
+		}
+	}
+	return resp.NewCommand(args...)
+}
+
+// peerReply returns the reply to a PEER command: an array of the time the reply
+// was cached and the time it expires, in Unix milliseconds (0 if it doesn't
+// expire), followed by the reply itself.
+func peerReply(timestamp, expires time.Time, response resp.Object) []byte {
+	var expiresMillis int64
+	if !expires.IsZero() {
+		expiresMillis = unixMillis(expires)
+	}
+	header := fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n", unixMillis(timestamp), expiresMillis)
+	return append([]byte(header), response.Raw()...)
+}
+
+// parsePeerReply returns the reply from a PEER command's reply (see peerReply),
+// set to expire maxAge after it was cached or when the owner's copy expires,
+// whichever is sooner.
+func parsePeerReply(obj resp.Object, maxAge time.Duration) (resp.Object, error) {
+	elements, ok := redis.ArrayElements(obj)
+	if !ok || len(elements) != 3 {
+		return nil, errPeerReply
+	}
+	timestamp, ok := redis.IntegerValue(elements[0])
+	if !ok {
+		return nil, errPeerReply
+	}
+	ownerExpires, ok := redis.IntegerValue(elements[1])
+	if !ok {
+		return nil, errPeerReply
+	}
+
+	expires := fromUnixMillis(timestamp).Add(maxAge)
+	if ownerExpires > 0 && fromUnixMillis(ownerExpires).Before(expires) {
+		expires = fromUnixMillis(ownerExpires)
+	}
+	return cache.ExpiringObject{Object: elements[2], Expires: expires}, nil
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// fromPeerKey marks the context of a PEER command, whose cache fill is never
+// passed on to another peer. This keeps peers that disagree about the owner of
+// a key from passing requests back and forth.
+type fromPeerKey struct{}
+
+// handlePeer handles a PEER command from another instance in the peer group,
+// asking this instance for a cached reply that it owns:
+//
+//	PEER milliseconds command [args...]
+//
+// It's like CACHED with the max age in milliseconds, except that the reply is
+// always filled locally. For a single key or field of MGET or HMGET, the reply
+// is the element that's cached for it (see expandedDo). See peerReply for the
+// reply format.
+func (s *Server) handlePeer(args []string, server *redis.ServerConn) []byte {
+	if len(args) < 3 {
+		return resp.NewError("ERR wrong number of arguments for 'peer' command")
+	}
+	ms, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || ms < 0 {
+		return resp.NewError("ERR syntax error")
+	}
+	args = args[2:]
+	name := strings.ToUpper(args[0])
+	if reason := s.uncacheableReason(name); len(reason) > 0 {
+		return resp.NewError(fmt.Sprintf("aorta: can't cache %s command '%s'", reason, strings.ToLower(name)))
+	}
+	if s.Peers != nil {
+		atomic.AddInt64(&s.Peers.Served, 1)
+	}
+
+	command := resp.NewCommand(args...)
+	key := s.cacheKey(command, server)
+	maxAge := time.Now().Add(-time.Duration(ms) * time.Millisecond)
+	deadline := s.serverTimeouts.Dial + s.serverTimeouts.Write + s.serverTimeouts.Read
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	ctx = context.WithValue(ctx, fromPeerKey{}, true)
+
+	var response resp.Object
+	var hit bool
+	if n, ok := expandedCommands[name]; ok && len(args) == n+1 {
+		// The entry for a single key or field of an expanded command holds
+		// its element of the reply, not the whole reply (see expandedDo)
+		response, hit, err = s.expandedDo(ctx, name, args, maxAge, server, nil)
+		if err == nil {
+			elements, ok := redis.ArrayElements(response)
+			if !ok || len(elements) != 1 {
+				return response.Raw()
+			}
+			response = elements[0]
+		}
+	} else {
+		response, hit, err = s.cachedDo(ctx, key, maxAge, command, server, deadline, s.readTags(args, server, nil))
+	}
+	if err != nil {
+		return resp.NewError(err.Error())
+	}
+	s.cacheStats.count(server.Address(), name, hit)
+	s.track(args, server, true)
+
+	timestamp := time.Now()
+	var expires time.Time
+	if entry, ok := s.Cache.Entry(key); ok {
+		timestamp, expires = entry.Timestamp, entry.Expires
+	}
+	return peerReply(timestamp, expires, response)
+}
+
+// handlePeerInvalidate handles a PEERINVALIDATE command from another instance
+// in the peer group, which removes the cached replies with any of the given
+// tags after a write through that instance (see Peers.invalidate):
+//
+//	PEERINVALIDATE tag [tag ...]
+func (s *Server) handlePeerInvalidate(args []string) []byte {
+	if len(args) < 2 {
+		return resp.NewError("ERR wrong number of arguments for 'peerinvalidate' command")
+	}
+	for _, tag := range args[1:] {
+		s.Cache.InvalidateTag(tag)
+	}
+	return resp.OK
+}
+
+// peerFetch is like fetch, but if the Server is in a peer group and another
+// peer owns the given cache key, it asks the owner for the reply instead. The
+// reply is fetched from the Redis server as usual if the owner can't be
+// reached.
+func (s *Server) peerFetch(ctx context.Context, key string, maxAge time.Duration, command resp.Command, conn *redis.ServerConn) (resp.Object, error) {
+	if owner, ok := s.peerOwner(ctx, key); ok {
+		response, err := s.Peers.fetch(ctx, owner, maxAge, command, conn)
+		if _, ok := err.(resp.Error); ok || err == nil || ctx.Err() != nil {
+			return response, err
+		}
+		DEBUG("Filling cached reply locally: %s", err.Error())
+	}
+	return s.fetch(ctx, command, conn)
+}
+
+// peerOwner returns the peer that owns the given cache key if the Server is in
+// a peer group, the owner is another peer, and the fill wasn't itself asked
+// for by a peer.
+func (s *Server) peerOwner(ctx context.Context, key string) (string, bool) {
+	if s.Peers == nil || ctx.Value(fromPeerKey{}) != nil {
+		return "", false
+	}
+	owner := s.Peers.Owner(key)
+	return owner, owner != s.Peers.Self
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bytes"
+	"github.com/stvp/aorta/cache"
+	"github.com/stvp/aorta/redis"
+	"github.com/stvp/resp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPeersOwner(t *testing.T) {
+	peers := NewPeers("10.0.0.1:7979", "pw", redis.NewTimeouts(time.Second))
+	if owner := peers.Owner("a"); owner != "10.0.0.1:7979" {
+		t.Errorf("expected an empty group to own nothing but itself, got %s", owner)
+	}
+
+	peers.Set("10.0.0.1:7979", "10.0.0.2:7979", "10.0.0.3:7979")
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		owners[key] = peers.Owner(key)
+		counts[owners[key]]++
+	}
+	if len(counts) != 3 {
+		t.Fatalf("expected keys to be spread over 3 peers, got %v", counts)
+	}
+	for owner, n := range counts {
+		if n < 500 {
+			t.Errorf("expected %s to own about a third of the keys, got %d", owner, n)
+		}
+	}
+
+	// Adding a peer only moves keys to the new peer
+	peers.Set("10.0.0.1:7979", "10.0.0.2:7979", "10.0.0.3:7979", "10.0.0.4:7979")
+	var moved int
+	for key, owner := range owners {
+		if got := peers.Owner(key); got != owner {
+			moved++
+			if got != "10.0.0.4:7979" {
+				t.Fatalf("expected %s to move to the new peer, got %s", key, got)
+			}
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Errorf("expected about a quarter of the keys to move, got %d", moved)
+	}
+}
+
+func TestPeerReply(t *testing.T) {
+	timestamp := time.Now().Add(-10 * time.Second).Truncate(time.Millisecond)
+	reply := resp.NewBulkString("value")
+
+	tests := []struct {
+		expires  time.Time
+		maxAge   time.Duration
+		expected time.Time
+	}{
+		{time.Time{}, time.Minute, timestamp.Add(time.Minute)},
+		{timestamp.Add(time.Second), time.Minute, timestamp.Add(time.Second)},
+		{timestamp.Add(time.Hour), time.Minute, timestamp.Add(time.Minute)},
+	}
+	for i, test := range tests {
+		raw := peerReply(timestamp, test.expires, reply)
+		obj, err := parsePeerReply(resp.Array(raw), test.maxAge)
+		if err != nil {
+			t.Fatalf("tests[%d]: %s", i, err)
+		}
+		e, ok := obj.(cache.ExpiringObject)
+		if !ok {
+			t.Fatalf("tests[%d]: expected a cache.ExpiringObject, got %#v", i, obj)
+		}
+		if !bytes.Equal(e.Raw(), reply.Raw()) {
+			t.Errorf("tests[%d]: expected %q, got %q", i, reply.Raw(), e.Raw())
+		}
+		if !e.Expires.Equal(test.expected) {
+			t.Errorf("tests[%d]: expected expiry %s, got %s", i, test.expected, e.Expires)
+		}
+	}
+
+	for _, bad := range []resp.Object{resp.NewBulkString("value"), resp.Array("*2\r\n:1\r\n:2\r\n")} {
+		if _, err := parsePeerReply(bad, time.Minute); err != errPeerReply {
+			t.Errorf("expected errPeerReply for %q, got %v", bad.Raw(), err)
+		}
+	}
+}
+
+func TestProxyCommand(t *testing.T) {
+	conn := redis.NewFailoverServerConn([]string{"10.0.0.1:6379", "10.0.0.2:6380"}, "pw", redis.NewTimeouts(time.Second))
+	expected := resp.NewCommand("PROXY", "10.0.0.1", "6379", "pw", "10.0.0.2", "6380")
+	if got := proxyCommand(conn); !bytes.Equal(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestHandlePeer_Errors(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", 0, 0)
+	conn := redis.NewServerConn("10.0.0.1:6379", "", time.Second)
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"PEER", "1000"}, "ERR wrong number of arguments for 'peer' command"},
+		{[]string{"PEER", "soon", "GET", "a"}, "ERR syntax error"},
+		{[]string{"PEER", "1000", "INCR", "a"}, "aorta: can't cache write command 'incr'"},
+	}
+	for i, test := range tests {
+		got := proxy.handlePeer(test.args, conn)
+		if expected := resp.NewError(test.err); !bytes.Equal(got, expected) {
+			t.Errorf("tests[%d]: expected %q, got %q", i, expected, got)
+		}
+	}
+}
+
+func TestHandlePeerInvalidate(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", 0, 0)
+	proxy.Cache.Set("a", cache.TaggedObject{Object: resp.NewBulkString("a"), Tags: []string{"x"}})
+	proxy.Cache.Set("b", cache.TaggedObject{Object: resp.NewBulkString("b"), Tags: []string{"y"}})
+
+	if got := proxy.handlePeerInvalidate([]string{"PEERINVALIDATE"}); !bytes.Equal(got, resp.NewError("ERR wrong number of arguments for 'peerinvalidate' command")) {
+		t.Errorf("expected an error, got %q", got)
+	}
+	if got := proxy.handlePeerInvalidate([]string{"PEERINVALIDATE", "x", "z"}); !bytes.Equal(got, resp.OK) {
+		t.Errorf("expected OK, got %q", got)
+	}
+	if _, ok := proxy.Cache.Entry("a"); ok {
+		t.Error("expected \"a\" to be invalidated")
+	}
+	if _, ok := proxy.Cache.Entry("b"); !ok {
+		t.Error("expected \"b\" to be cached")
+	}
+}
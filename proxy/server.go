@@ -1,7 +1,7 @@
 package proxy
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"github.com/stvp/aorta/cache"
 	"github.com/stvp/aorta/redis"
@@ -10,19 +10,66 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	// Settings
-	password      string
-	clientTimeout time.Duration
-	serverTimeout time.Duration
+	password       string
+	clientTimeouts redis.Timeouts
+	serverTimeouts redis.Timeouts
 
 	bind     string
 	listener net.Listener
 	Pool     *redis.ServerConnPool
-	Cache    *cache.Cache
+	Cache    cache.Store
+
+	// Mirror, if set, receives a copy of every command sent to a Redis server.
+	Mirror *Mirror
+
+	// CacheableCommands lists extra commands, by upper-case name, that can be
+	// used with CACHED and CACHEDSTALE. CacheUnknown allows any command that
+	// isn't known to be uncacheable. See uncacheableReason.
+	CacheableCommands map[string]bool
+	CacheUnknown      bool
+
+	// HashKeys, if set, stores cached replies under the SHA-256 sum of their
+	// cache key instead of the full key, which can be large for commands with
+	// large arguments.
+	HashKeys bool
+
+	// DigestKey is the HMAC key for the Redis password digests in cache keys
+	// (see passwordDigest). NewServer sets a random key, so cache keys change
+	// from one process to the next. Servers that share cache keys, through a
+	// snapshot or a peer group, need to use the same key.
+	DigestKey []byte
+
+	// NegativeErrors lists Redis error classes (e.g. WRONGTYPE) that CACHED
+	// and CACHEDSTALE cache like other replies. See IsNegativeReply.
+	NegativeErrors map[string]bool
+
+	// Peers, if set, shares cached replies with other aorta instances. See
+	// Peers.
+	Peers *Peers
+
+	// KeyTTL, if set, limits cached replies to commands that read a single
+	// Redis key to the key's remaining TTL. See fetch.
+	KeyTTL bool
+
+	// Invalidation, if set, opens a connection to each Redis server with cached
+	// replies to listen for key changes. See redis.InvalidationConn.
+	Invalidation      bool
+	invalidators      map[string]*redis.InvalidationConn
+	invalidatorsMutex sync.Mutex
+
+	cacheStats cacheStats
+
+	// Cache keys waiting to be filled by WarmupBackground, with the number of
+	// warmup commands for each
+	warming      map[string]int
+	warmingMutex sync.Mutex
 
 	// Stats
 	TotalClientConns   int
@@ -30,14 +77,23 @@ type Server struct {
 }
 
 func NewServer(bind, password string, clientTimeout, serverTimeout time.Duration) *Server {
-	return &Server{
-		password:      password,
-		clientTimeout: clientTimeout,
-		serverTimeout: serverTimeout,
-		bind:          bind,
-		Pool:          redis.NewServerConnPool(),
-		Cache:         cache.NewCache(),
+	return NewServerTimeouts(bind, password, redis.NewTimeouts(clientTimeout), redis.NewTimeouts(serverTimeout))
+}
+
+// NewServerTimeouts is like NewServer but takes separate dial, read and write
+// timeouts for client and server connections.
+func NewServerTimeouts(bind, password string, clientTimeouts, serverTimeouts redis.Timeouts) *Server {
+	s := &Server{
+		password:       password,
+		clientTimeouts: clientTimeouts,
+		serverTimeouts: serverTimeouts,
+		bind:           bind,
+		Pool:           redis.NewServerConnPool(),
+		Cache:          cache.NewCache(),
+		DigestKey:      NewDigestKey(),
 	}
+	s.Pool.OnExpire = s.unwatch
+	return s
 }
 
 func (s *Server) Listen() error {
@@ -66,10 +122,11 @@ func (s *Server) Close() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	s.closeInvalidators()
 }
 
 func (s *Server) handle(conn net.Conn) {
-	client := redis.NewClientConn(conn, s.clientTimeout)
+	client := redis.NewClientConnTimeouts(conn, s.clientTimeouts)
 	defer client.Close()
 
 	s.TotalClientConns++
@@ -128,15 +185,33 @@ func (s *Server) handle(conn net.Conn) {
 			return
 		}
 
+		if commandName == "CACHE" {
+			client.Write(s.handleCache(args, server))
+			continue
+		}
+
+		// Handle write invalidations from other instances in the peer group
+		if commandName == "PEERINVALIDATE" {
+			client.Write(s.handlePeerInvalidate(args))
+			continue
+		}
+
 		// Require destination server
 		if commandName == "PROXY" {
 			server = nil
-			if len(args) != 4 {
+			if len(args) < 4 || len(args)%2 != 0 {
 				client.WriteError("ERR wrong number of arguments for 'proxy' command")
 				continue
 			}
-			address := fmt.Sprintf("%s:%s", args[1], args[2])
-			server = s.Pool.Get(address, args[3], s.serverTimeout)
+			// PROXY host port auth [host port ...]
+			addresses := []string{fmt.Sprintf("%s:%s", args[1], args[2])}
+			for i := 4; i < len(args); i += 2 {
+				addresses = append(addresses, fmt.Sprintf("%s:%s", args[i], args[i+1]))
+			}
+			server = s.Pool.GetFailover(addresses, args[3], s.serverTimeouts)
+			if s.Invalidation {
+				s.watch(s.backendKey(server), server)
+			}
 			client.Write(resp.OK)
 			continue
 		}
@@ -146,29 +221,133 @@ func (s *Server) handle(conn net.Conn) {
 			continue
 		}
 
+		// Handle cache fills for other instances in the peer group
+		if commandName == "PEER" {
+			client.Write(s.handlePeer(args, server))
+			continue
+		}
+
+		// Handle TIMEOUT command prefix
+		readTimeout := s.serverTimeouts.Read
+		if commandName == "TIMEOUT" {
+			if len(args) < 3 {
+				client.WriteError("ERR wrong number of arguments for 'timeout' command")
+				continue
+			}
+			ms, err := strconv.Atoi(args[1])
+			if err != nil || ms <= 0 {
+				client.WriteError("ERR syntax error")
+				continue
+			}
+			readTimeout = time.Duration(ms) * time.Millisecond
+			args = args[2:]
+			commandName = strings.ToUpper(args[0])
+			command = resp.NewCommand(args...)
+		}
+
 		// Handle CACHED command prefix
 		var maxAge time.Time
+		cached := commandName == "CACHED" || commandName == "CACHEDSTALE"
 		if commandName == "CACHED" {
 			if len(args) < 3 {
 				client.WriteError("ERR wrong number of arguments for 'cached' command")
 				return
 			}
 			secs, err := strconv.Atoi(args[1])
-			if err != nil {
+			if err != nil || secs < 0 {
 				client.WriteError("ERR syntax error")
+				continue
 			}
 			maxAge = time.Now().Add(-time.Duration(secs) * time.Second)
-			command = resp.NewCommand((args[2:])...)
-		} else {
-			maxAge = time.Now()
+			args = args[2:]
+			commandName = strings.ToUpper(args[0])
+			command = resp.NewCommand(args...)
 		}
 
-		// Handle the command
-		response, err := s.cachedDo(maxAge, command, server)
-		if err != nil {
+		// Handle CACHEDSTALE command prefix
+		var staleAge time.Time
+		if commandName == "CACHEDSTALE" {
+			if len(args) < 4 {
+				client.WriteError("ERR wrong number of arguments for 'cachedstale' command")
+				continue
+			}
+			secs, err := strconv.Atoi(args[1])
+			if err != nil || secs < 0 {
+				client.WriteError("ERR syntax error")
+				continue
+			}
+			graceSecs, err := strconv.Atoi(args[2])
+			if err != nil || graceSecs < 0 {
+				client.WriteError("ERR syntax error")
+				continue
+			}
+			maxAge = time.Now().Add(-time.Duration(secs) * time.Second)
+			staleAge = maxAge.Add(-time.Duration(graceSecs) * time.Second)
+			args = args[3:]
+			commandName = strings.ToUpper(args[0])
+			command = resp.NewCommand(args...)
+		}
+
+		// Handle TAG options after CACHED or CACHEDSTALE
+		var tags []string
+		for cached && commandName == "TAG" && len(args) >= 3 {
+			tags = append(tags, userTag(args[1]))
+			args = args[2:]
+			commandName = strings.ToUpper(args[0])
+			command = resp.NewCommand(args...)
+		}
+
+		if cached {
+			if reason := s.uncacheableReason(commandName); len(reason) > 0 {
+				client.WriteError(fmt.Sprintf("aorta: can't cache %s command '%s'", reason, strings.ToLower(commandName)))
+				continue
+			}
+		}
+
+		// Handle the command. In-flight work is canceled if the client goes away
+		// or the command's deadline passes.
+		deadline := s.serverTimeouts.Dial + s.serverTimeouts.Write + readTimeout
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		go func() {
+			select {
+			case <-client.Gone():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		key := s.cacheKey(command, server)
+		if cached && s.warmingUp(s.cachedKeys(args, server, staleAge.IsZero()), maxAge) {
+			cancel()
+			client.WriteError("aorta: cache warming up")
+			continue
+		}
+		var response resp.Object
+		var hit bool
+		if !cached {
+			response, err = s.do(ctx, command, server)
+		} else if n, ok := expandedCommands[commandName]; ok && staleAge.IsZero() && len(args) > n {
+			response, hit, err = s.expandedDo(ctx, commandName, args, maxAge, server, tags)
+		} else if staleAge.IsZero() {
+			response, hit, err = s.cachedDo(ctx, key, maxAge, command, server, deadline, s.readTags(args, server, tags))
+		} else {
+			response, hit, err = s.staleCachedDo(ctx, key, maxAge, staleAge, command, server, deadline, s.readTags(args, server, tags))
+		}
+		cancel()
+		if _, rejected := err.(resp.Error); !cached && !rejected {
+			// A write that fails or times out may still have changed keys on
+			// the server, so only a Redis error reply skips invalidation
+			s.track(args, server, false)
+		}
+		if err == context.Canceled {
+			return
+		} else if err != nil {
 			client.WriteError(err.Error())
 			continue
 		}
+		if cached {
+			s.cacheStats.count(server.Address(), commandName, hit)
+			s.track(args, server, true)
+		}
 
 		err = client.Write(response.Raw())
 		if err != nil {
@@ -177,20 +356,108 @@ func (s *Server) handle(conn net.Conn) {
 	}
 }
 
-func (s *Server) cachedDo(maxAge time.Time, command resp.Command, conn *redis.ServerConn) (resp.Object, error) {
-	key := s.cacheKey(command, conn)
-	return s.Cache.Fetch(key, maxAge, func() (resp.Object, error) {
-		return conn.Do(command)
+// do runs a command without a CACHED or CACHEDSTALE prefix. It doesn't go
+// through the cache at all, so that writes are never shared between clients,
+// replaced by stale replies, or repeated by refresh-ahead.
+func (s *Server) do(ctx context.Context, command resp.Command, conn *redis.ServerConn) (resp.Object, error) {
+	response, err := conn.DoContext(ctx, command)
+	if s.Mirror != nil && ctx.Err() == nil {
+		s.Mirror.Send(conn.Address(), command, response, err)
+	}
+	if err == context.DeadlineExceeded {
+		err = redis.ErrTimeout
+	}
+	return response, err
+}
+
+// cachedDo runs the given command, or returns its cached reply if the reply
+// isn't older than maxAge. It also returns whether the reply was cached. A
+// newly cached reply gets the given tags (see readTags). The cache may call
+// the fill function again later to refresh the reply ahead of time (see
+// cache.Cache.Refresh), in which case it gets its own timeout instead of the
+// given context.
+func (s *Server) cachedDo(ctx context.Context, key string, maxAge time.Time, command resp.Command, conn *redis.ServerConn, timeout time.Duration, tags []string) (resp.Object, bool, error) {
+	var filled, done int32
+	age := time.Since(maxAge)
+	response, err := s.Cache.FetchContext(ctx, key, maxAge, func() (resp.Object, error) {
+		fillCtx := ctx
+		if atomic.LoadInt32(&done) == 1 {
+			var cancel context.CancelFunc
+			fillCtx, cancel = context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+		} else {
+			atomic.StoreInt32(&filled, 1)
+		}
+		response, err := s.peerFetch(fillCtx, key, age, command, conn)
+		if s.Mirror != nil && fillCtx.Err() == nil {
+			s.Mirror.Send(conn.Address(), command, response, err)
+		}
+		if err != nil {
+			return response, err
+		}
+		return cache.TaggedObject{Object: response, Tags: tags}, nil
+	})
+	atomic.StoreInt32(&done, 1)
+	if err == context.DeadlineExceeded {
+		err = redis.ErrTimeout
+	}
+	return response, atomic.LoadInt32(&filled) == 0, err
+}
+
+// staleCachedDo is like cachedDo but allows stale cached values. See
+// cache.Cache.FetchStale. The cache fill may run in the background after the
+// client has its reply, so it isn't canceled along with the given context.
+func (s *Server) staleCachedDo(ctx context.Context, key string, maxAge, staleAge time.Time, command resp.Command, conn *redis.ServerConn, timeout time.Duration, tags []string) (resp.Object, bool, error) {
+	var filled int32
+	response, err := s.Cache.FetchStaleContext(ctx, key, maxAge, staleAge, func() (resp.Object, error) {
+		atomic.StoreInt32(&filled, 1)
+		fillCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		response, err := s.peerFetch(fillCtx, key, time.Since(maxAge), command, conn)
+		if s.Mirror != nil {
+			s.Mirror.Send(conn.Address(), command, response, err)
+		}
+		if err != nil {
+			return response, err
+		}
+		return cache.TaggedObject{Object: response, Tags: tags}, nil
 	})
+	if err == context.DeadlineExceeded {
+		err = redis.ErrTimeout
+	}
+	return response, atomic.LoadInt32(&filled) == 0, err
 }
 
-func (s *Server) cacheKey(command resp.Command, conn *redis.ServerConn) string {
-	var buf bytes.Buffer
-	buf.WriteString(conn.Address())
-	buf.WriteString(conn.Password())
-	args, _ := command.Slices()
-	for _, arg := range args {
-		buf.Write(arg)
+// track keeps cached replies consistent with writes made through the proxy.
+// Commands sent without CACHED or CACHEDSTALE invalidate the cached replies
+// for the Redis keys they may change, or all cached replies for the server if
+// they may change any key (see writtenKeys). Cached replies are tagged with
+// the keys they read as they're cached (see readTags). In a peer group, the
+// other peers invalidate them too. With Invalidation, a cached command also
+// makes sure the proxy is listening for changes made outside it, in case the
+// server's connection has failed over to another address since PROXY.
+func (s *Server) track(args []string, conn *redis.ServerConn, cached bool) {
+	backend := s.backendKey(conn)
+	if cached {
+		if s.Invalidation {
+			s.watch(backend, conn)
+		}
+		return
+	}
+
+	var tags []string
+	keys, all := s.writtenKeys(args)
+	if all {
+		tags = []string{backendTag(backend)}
+	} else {
+		for _, k := range keys {
+			tags = append(tags, keyTag(backend, k))
+		}
+	}
+	for _, tag := range tags {
+		s.Cache.InvalidateTag(tag)
+	}
+	if s.Peers != nil && len(tags) > 0 {
+		s.Peers.invalidate(context.Background(), tags)
 	}
-	return buf.String()
 }
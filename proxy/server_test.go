@@ -2,12 +2,14 @@ package proxy
 
 import (
 	"github.com/garyburd/redigo/redis"
+	"github.com/stvp/aorta/cache"
 	r "github.com/stvp/aorta/redis"
 	"github.com/stvp/resp"
 	"github.com/stvp/tempredis"
 	"io"
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -302,3 +304,597 @@ func BenchmarkProxyServer(b *testing.B) {
 		b.StopTimer()
 	})
 }
+
+func TestProxyServer_Timeout(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+
+		// Default read timeout is too short
+		_, err := conn.Do("DEBUG", "SLEEP", "0.03")
+		if err == nil || err.Error() != "aorta: timeout" {
+			t.Fatalf("expected timeout, got: %#v", err)
+		}
+
+		// Give the command more time
+		conn = dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		time.Sleep(30 * time.Millisecond)
+		response, err := redis.String(conn.Do("TIMEOUT", "100", "DEBUG", "SLEEP", "0.03"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response != "OK" {
+			t.Fatalf("Expected OK, got: %#v", response)
+		}
+
+		// Invalid timeout
+		_, err = conn.Do("TIMEOUT", "nope", "PING")
+		if err == nil || err.Error() != "ERR syntax error" {
+			t.Fatalf("expected syntax error, got: %#v", err)
+		}
+	})
+}
+
+func TestProxyServer_WriteInvalidation(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		conn.Do("SET", "user:1", "old")
+		conn.Do("SET", "user:2", "old")
+
+		got, err := redis.String(conn.Do("CACHED", "60", "GET", "user:1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "old" {
+			t.Fatalf("expected \"old\", got: %#v", got)
+		}
+		conn.Do("CACHED", "60", "MGET", "user:1", "user:2")
+
+		// Writes invalidate cached reads of the same key
+		conn.Do("SET", "user:1", "new")
+		got, err = redis.String(conn.Do("CACHED", "60", "GET", "user:1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "new" {
+			t.Fatalf("expected \"new\", got: %#v", got)
+		}
+		values, err := redis.Strings(conn.Do("CACHED", "60", "MGET", "user:1", "user:2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values[0] != "new" {
+			t.Fatalf("expected \"new\", got: %#v", values[0])
+		}
+
+		// Writes that aren't keyed commands, like GETDEL, are invalidated too
+		conn.Do("GETDEL", "user:1")
+		_, err = redis.String(conn.Do("CACHED", "60", "GET", "user:1"))
+		if err == nil || err.Error() != "redigo: nil returned" {
+			t.Fatalf("expected nil, got: %#v", err)
+		}
+
+		// Scripts may write any key, so they invalidate everything
+		conn.Do("CACHED", "60", "GET", "user:2")
+		conn.Do("EVAL", "return redis.call('SET', 'user:2', 'script')", "0")
+		got, err = redis.String(conn.Do("CACHED", "60", "GET", "user:2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "script" {
+			t.Fatalf("expected \"script\", got: %#v", got)
+		}
+
+		// Redis error replies don't change anything, so they don't invalidate
+		n := proxy.Cache.Len()
+		if _, err := conn.Do("INCR", "user:2"); err == nil {
+			t.Fatal("expected an error")
+		}
+		if proxy.Cache.Len() != n {
+			t.Errorf("expected %d cached replies, got: %d", n, proxy.Cache.Len())
+		}
+
+		// Writes that time out may still change keys, so they invalidate
+		script := "local start = redis.call('TIME') " +
+			"repeat local now = redis.call('TIME') until (now[1] - start[1]) * 1000000 + now[2] - start[2] > 50000 " +
+			"return redis.call('SET', KEYS[1], 'slow')"
+		if _, err := conn.Do("TIMEOUT", "10", "EVAL", script, "1", "user:2"); err == nil {
+			t.Fatal("expected a timeout")
+		}
+		time.Sleep(100 * time.Millisecond)
+		got, err = redis.String(conn.Do("CACHED", "60", "GET", "user:2"))
+		if err != nil || got != "slow" {
+			t.Fatalf("expected \"slow\", got: %#v, %#v", got, err)
+		}
+
+		// FLUSHDB invalidates everything
+		conn.Do("FLUSHDB")
+		_, err = redis.String(conn.Do("CACHED", "60", "GET", "user:2"))
+		if err == nil || err.Error() != "redigo: nil returned" {
+			t.Fatalf("expected nil, got: %#v", err)
+		}
+	})
+}
+
+func TestProxyServer_CacheStats(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		conn.Do("CACHED", "60", "GET", "foo")
+		conn.Do("CACHED", "60", "GET", "foo")
+
+		stats, err := redis.String(conn.Do("CACHE", "STATS"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stats, serverConfig.Address()+":keys=1,hits=1,misses=1\r\n") {
+			t.Errorf("missing server stats: %s", stats)
+		}
+		if !strings.Contains(stats, "get:hits=1,misses=1\r\n") {
+			t.Errorf("missing command stats: %s", stats)
+		}
+
+		info, err := redis.String(conn.Do("CACHE", "INFO", "GET", "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(info, "server="+serverConfig.Address()+" command=get keys=foo age=") {
+			t.Errorf("unexpected info: %s", info)
+		}
+	})
+}
+
+func TestProxyServer_CachedWrite(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+
+		_, err := conn.Do("CACHED", "60", "INCR", "counter")
+		if err == nil || err.Error() != "aorta: can't cache write command 'incr'" {
+			t.Errorf("expected write command error, got: %#v", err)
+		}
+		count, err := redis.Int64(conn.Do("INCR", "counter"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("rejected CACHED command shouldn't have run, got count: %d", count)
+		}
+	})
+}
+
+func TestProxyServer_CachedSyntax(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+
+		for _, args := range [][]interface{}{
+			{"CACHED", "nope", "GET", "foo"},
+			{"CACHED", "-1", "GET", "foo"},
+			{"CACHEDSTALE", "nope", "60", "GET", "foo"},
+			{"CACHEDSTALE", "60", "nope", "GET", "foo"},
+			{"CACHEDSTALE", "-1", "60", "GET", "foo"},
+			{"CACHEDSTALE", "60", "-1", "GET", "foo"},
+		} {
+			_, err := conn.Do(args[0].(string), args[1:]...)
+			if err == nil || err.Error() != "ERR syntax error" {
+				t.Errorf("expected syntax error for %v, got: %#v", args, err)
+			}
+		}
+		if n := proxy.Cache.Len(); n != 0 {
+			t.Errorf("expected nothing to be cached, got %d keys", n)
+		}
+
+		// Only the error is sent, so later replies still match their commands
+		if got, err := redis.String(conn.Do("PING")); err != nil || got != "PONG" {
+			t.Errorf("expected PONG, got: %#v, %#v", got, err)
+		}
+	})
+}
+
+func TestProxyServer_UncachedCommands(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		proxy.Cache.(*cache.Cache).StaleIfError = func(error) bool { return true }
+		proxy.Cache.(*cache.Cache).MaxStale = time.Minute
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		conn.Do("SET", "a", "1")
+		conn.Do("GET", "a")
+		if n := proxy.Cache.Len(); n != 0 {
+			t.Fatalf("expected commands without CACHED not to be cached, got %d cached replies", n)
+		}
+
+		// A write that fails isn't answered with an earlier reply
+		servers[0].Term()
+		_, err := conn.Do("SET", "a", "2")
+		if err == nil {
+			t.Error("expected an error for a write to a server that's down")
+		}
+	})
+}
+
+func TestProxyServer_RefreshOnlyCached(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		c := proxy.Cache.(*cache.Cache)
+		c.RefreshAhead = 0.99
+		c.RefreshMinHits = 2
+		c.RefreshColdAfter = time.Minute
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		for i := 0; i < 10; i++ {
+			conn.Do("INCR", "counter")
+		}
+
+		// Commands without CACHED are never replayed by refresh-ahead
+		for i := 0; i < 5; i++ {
+			c.Refresh()
+			time.Sleep(10 * time.Millisecond)
+		}
+		count, err := redis.Int64(conn.Do("GET", "counter"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 10 {
+			t.Errorf("expected INCR to run 10 times, got: %d", count)
+		}
+		if n := c.Stats().Refreshes; n != 0 {
+			t.Errorf("expected no refreshes, got: %d", n)
+		}
+	})
+}
+
+func TestProxyServer_FillLimitsOnlyCached(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		c := proxy.Cache.(*cache.Cache)
+		c.MaxWait = time.Nanosecond
+		c.FillTimeout = time.Nanosecond
+		c.StaleIfError = func(error) bool { return true }
+		c.MaxStale = time.Minute
+		serverConfig := servers[0].Config
+
+		// Simultaneous identical writes all run and get their own replies
+		done := make(chan int64)
+		for i := 0; i < 5; i++ {
+			go func() {
+				conn := dialProxy(proxy)
+				defer conn.Close()
+				conn.Do("AUTH", "pw")
+				conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+				n, _ := redis.Int64(conn.Do("INCR", "counter"))
+				done <- n
+			}()
+		}
+		seen := map[int64]bool{}
+		for i := 0; i < 5; i++ {
+			seen[<-done] = true
+		}
+		if len(seen) != 5 {
+			t.Errorf("expected 5 distinct INCR replies, got: %v", seen)
+		}
+		if stats := c.Stats(); stats.WaitTimeouts != 0 || stats.FillTimeouts != 0 {
+			t.Errorf("expected no wait or fill timeouts, got: %d and %d", stats.WaitTimeouts, stats.FillTimeouts)
+		}
+	})
+}
+
+func TestProxyServer_CachedMGET(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		conn.Do("MSET", "a", "1", "b", "2", "c", "3")
+		conn.Do("HMSET", "h", "x", "1", "y", "2")
+
+		values, err := redis.Strings(conn.Do("CACHED", "60", "MGET", "a", "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(values, ",") != "1,2" {
+			t.Errorf("unexpected MGET reply: %#v", values)
+		}
+		conn.Do("CACHED", "60", "HMGET", "h", "x")
+
+		// Change the values behind the proxy's back
+		direct := r.NewServerConn(serverConfig.Address(), serverConfig.Password(), time.Second)
+		direct.Do(resp.NewCommand("MSET", "a", "10", "b", "20", "c", "30"))
+		direct.Do(resp.NewCommand("HMSET", "h", "x", "10", "y", "20"))
+
+		// Cached keys are reused and missing keys are fetched
+		values, err = redis.Strings(conn.Do("CACHED", "60", "mget", "c", "b", "nope", "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(values, ",") != "30,2,,2" {
+			t.Errorf("unexpected MGET reply: %#v", values)
+		}
+		if n := proxy.Cache.Len(); n != 5 {
+			t.Errorf("expected 5 cached keys, got: %d", n)
+		}
+
+		values, err = redis.Strings(conn.Do("CACHED", "60", "HMGET", "h", "y", "x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(values, ",") != "20,1" {
+			t.Errorf("unexpected HMGET reply: %#v", values)
+		}
+
+		// Writes through the proxy invalidate single keys
+		conn.Do("SET", "b", "200")
+		values, _ = redis.Strings(conn.Do("CACHED", "60", "MGET", "a", "b"))
+		if strings.Join(values, ",") != "1,200" {
+			t.Errorf("unexpected MGET reply after write: %#v", values)
+		}
+	})
+}
+
+func TestProxyServer_CachedTags(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		conn.Do("SET", "user:42:name", "old")
+		conn.Do("HSET", "user:42", "name", "old")
+
+		conn.Do("CACHED", "60", "TAG", "user:42", "GET", "user:42:name")
+		conn.Do("CACHED", "60", "TAG", "user:42", "TAG", "users", "HGET", "user:42", "name")
+		conn.Do("CACHEDSTALE", "60", "60", "TAG", "user:42", "GET", "user:42:name")
+
+		// Change the values behind the proxy's back
+		direct := r.NewServerConn(serverConfig.Address(), serverConfig.Password(), time.Second)
+		direct.Do(resp.NewCommand("SET", "user:42:name", "new"))
+		direct.Do(resp.NewCommand("HSET", "user:42", "name", "new"))
+
+		got, _ := redis.String(conn.Do("CACHED", "60", "TAG", "user:42", "GET", "user:42:name"))
+		if got != "old" {
+			t.Fatalf("expected \"old\", got: %#v", got)
+		}
+
+		n, err := redis.Int(conn.Do("CACHE", "INVALIDATE", "TAG", "user:42"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("expected 2 invalidated results, got: %d", n)
+		}
+		got, _ = redis.String(conn.Do("CACHED", "60", "GET", "user:42:name"))
+		if got != "new" {
+			t.Errorf("expected \"new\", got: %#v", got)
+		}
+		got, _ = redis.String(conn.Do("CACHED", "60", "HGET", "user:42", "name"))
+		if got != "new" {
+			t.Errorf("expected \"new\", got: %#v", got)
+		}
+	})
+}
+
+func TestProxyServer_KeyTTL(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		proxy.KeyTTL = true
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		conn.Do("SET", "short", "old", "PX", "200")
+		conn.Do("SET", "forever", "old")
+
+		got, err := redis.String(conn.Do("CACHED", "300", "GET", "short"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "old" {
+			t.Fatalf("expected \"old\", got: %#v", got)
+		}
+		conn.Do("CACHED", "300", "MGET", "short", "forever")
+		conn.Do("CACHED", "300", "GET", "forever")
+
+		// Change the values behind the proxy's back once the short key expires
+		time.Sleep(300 * time.Millisecond)
+		direct := r.NewServerConn(serverConfig.Address(), serverConfig.Password(), time.Second)
+		direct.Do(resp.NewCommand("SET", "short", "new"))
+		direct.Do(resp.NewCommand("SET", "forever", "new"))
+
+		got, _ = redis.String(conn.Do("CACHED", "300", "GET", "short"))
+		if got != "new" {
+			t.Errorf("expected the expired key to be fetched again, got: %#v", got)
+		}
+		values, _ := redis.Strings(conn.Do("CACHED", "300", "MGET", "short", "forever"))
+		if strings.Join(values, ",") != "new,old" {
+			t.Errorf("unexpected MGET reply: %#v", values)
+		}
+		got, _ = redis.String(conn.Do("CACHED", "300", "GET", "forever"))
+		if got != "old" {
+			t.Errorf("expected the key without a TTL to stay cached, got: %#v", got)
+		}
+	})
+}
+
+func TestProxyServer_NegativeCaching(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		proxy.NegativeErrors = map[string]bool{"WRONGTYPE": true}
+		proxy.Cache.(*cache.Cache).IsNegative = IsNegativeReply
+		proxy.Cache.(*cache.Cache).NegativeMaxAge = 200 * time.Millisecond
+		serverConfig := servers[0].Config
+		conn := dialProxy(proxy)
+		conn.Do("AUTH", "pw")
+		conn.Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		conn.Do("HSET", "hash", "a", "1")
+
+		_, err := conn.Do("CACHED", "60", "GET", "hash")
+		if err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			t.Fatalf("expected WRONGTYPE, got: %#v", err)
+		}
+		conn.Do("CACHED", "60", "GET", "missing")
+
+		// Change the keys behind the proxy's back
+		direct := r.NewServerConn(serverConfig.Address(), serverConfig.Password(), time.Second)
+		direct.Do(resp.NewCommand("DEL", "hash"))
+		direct.Do(resp.NewCommand("SET", "hash", "string"))
+		direct.Do(resp.NewCommand("SET", "missing", "found"))
+
+		_, err = conn.Do("CACHED", "60", "GET", "hash")
+		if err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			t.Errorf("expected cached WRONGTYPE, got: %#v", err)
+		}
+		got, err := conn.Do("CACHED", "60", "GET", "missing")
+		if got != nil || err != nil {
+			t.Errorf("expected cached nil, got: %#v, %#v", got, err)
+		}
+		if n := proxy.Cache.Stats().NegativeHits; n != 2 {
+			t.Errorf("expected 2 negative hits, got: %d", n)
+		}
+
+		// Negative replies expire sooner
+		time.Sleep(300 * time.Millisecond)
+		s, _ := redis.String(conn.Do("CACHED", "60", "GET", "hash"))
+		if s != "string" {
+			t.Errorf("expected \"string\", got: %#v", s)
+		}
+		s, _ = redis.String(conn.Do("CACHED", "60", "GET", "missing"))
+		if s != "found" {
+			t.Errorf("expected \"found\", got: %#v", s)
+		}
+	})
+}
+
+func TestProxyServer_Peers(t *testing.T) {
+	withProxyAndServers(1, func(proxy *Server, servers []*tempredis.Server) {
+		proxy.Close()
+		serverConfig := servers[0].Config
+
+		// Start a group of peers in this process
+		addresses := []string{"127.0.0.1:12011", "127.0.0.1:12012", "127.0.0.1:12013"}
+		proxies := make([]*Server, len(addresses))
+		for i, address := range addresses {
+			proxies[i] = NewServer(address, "pw", time.Second, time.Second)
+			proxies[i].DigestKey = PeerDigestKey("pw")
+			proxies[i].Peers = NewPeers(address, "pw", r.NewTimeouts(time.Second))
+			proxies[i].Peers.Set(addresses...)
+			err := proxies[i].Listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxies[i].Close()
+		}
+
+		conns := make([]redis.Conn, len(proxies))
+		for i, p := range proxies {
+			conns[i] = dialProxy(p)
+			conns[i].Do("AUTH", "pw")
+			conns[i].Do("PROXY", serverConfig.Bind(), serverConfig.Port(), serverConfig.Password())
+		}
+		keys := make([]string, 30)
+		for i := range keys {
+			keys[i] = "key:" + strconv.Itoa(i)
+			conns[0].Do("SET", keys[i], "old")
+		}
+
+		direct := r.NewServerConn(serverConfig.Address(), serverConfig.Password(), time.Second)
+		direct.Do(resp.NewCommand("CONFIG", "RESETSTAT"))
+		for _, conn := range conns {
+			for _, key := range keys {
+				got, err := redis.String(conn.Do("CACHED", "60", "GET", key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != "old" {
+					t.Fatalf("expected \"old\", got: %#v", got)
+				}
+			}
+		}
+
+		// Each reply was only fetched from Redis once, by its owner
+		info, _ := direct.Do(resp.NewCommand("INFO", "commandstats"))
+		expected := "cmdstat_get:calls=" + strconv.Itoa(len(keys)) + ","
+		if !strings.Contains(string(info.Raw()), expected) {
+			t.Errorf("expected %q in INFO commandstats, got: %s", expected, info.Raw())
+		}
+		var requests, served int64
+		for _, p := range proxies {
+			requests += p.Peers.Requests
+			served += p.Peers.Served
+			if p.Cache.Len() != len(keys) {
+				t.Errorf("expected %d cached replies on %s, got %d", len(keys), p.Peers.Self, p.Cache.Len())
+			}
+		}
+		if requests == 0 || requests != served {
+			t.Errorf("expected requests to be served by peers, got %d requests and %d served", requests, served)
+		}
+
+		// CACHEDSTALE replies and the keys of CACHED MGET are shared too, so
+		// each key is only read from Redis once
+		var mgetArgs []interface{}
+		for i := 0; i < 10; i++ {
+			conns[0].Do("SET", "stale:"+strconv.Itoa(i), "stale")
+			conns[0].Do("SET", "mget:"+strconv.Itoa(i), "mget")
+			mgetArgs = append(mgetArgs, "mget:"+strconv.Itoa(i))
+		}
+		direct.Do(resp.NewCommand("CONFIG", "RESETSTAT"))
+		for _, conn := range conns {
+			for i := 0; i < 10; i++ {
+				got, err := redis.String(conn.Do("CACHEDSTALE", "60", "60", "GET", "stale:"+strconv.Itoa(i)))
+				if err != nil || got != "stale" {
+					t.Errorf("expected \"stale\", got: %#v, %#v", got, err)
+				}
+			}
+			got, err := redis.Strings(conn.Do("CACHED", append([]interface{}{"60", "MGET"}, mgetArgs...)...))
+			if err != nil || len(got) != 10 || got[9] != "mget" {
+				t.Errorf("expected 10 \"mget\" values, got: %#v, %#v", got, err)
+			}
+		}
+		info, _ = direct.Do(resp.NewCommand("INFO", "stats"))
+		if expected := "keyspace_hits:20\r\n"; !strings.Contains(string(info.Raw()), expected) {
+			t.Errorf("expected %q in INFO stats, got: %s", expected, info.Raw())
+		}
+
+		// A write through one peer invalidates the cached reply on every peer,
+		// including its owner
+		conns[1].Do("SET", keys[0], "new")
+		for i, conn := range conns {
+			got, err := redis.String(conn.Do("CACHED", "60", "GET", keys[0]))
+			if err != nil || got != "new" {
+				t.Errorf("conns[%d]: expected \"new\", got: %#v, %#v", i, got, err)
+			}
+		}
+
+		// Replies are filled locally when the owner is down
+		proxies[2].Close()
+		var missing string
+		backend := proxies[0].Pool.GetFailover([]string{serverConfig.Address()}, serverConfig.Password(), proxies[0].serverTimeouts)
+		for _, key := range keys {
+			key = "missing:" + key
+			if proxies[0].Peers.Owner(proxies[0].cacheKey(resp.NewCommand("GET", key), backend)) == addresses[2] {
+				missing = key
+				break
+			}
+		}
+		conns[0].Do("SET", missing, "value")
+		got, err := redis.String(conns[0].Do("CACHED", "60", "GET", missing))
+		if err != nil || got != "value" {
+			t.Errorf("expected \"value\", got: %#v, %#v", got, err)
+		}
+		// Both the SET's invalidation and the fill failed to reach the owner
+		if proxies[0].Peers.Errors != 2 {
+			t.Errorf("expected 2 peer errors, got: %d", proxies[0].Peers.Errors)
+		}
+	})
+}
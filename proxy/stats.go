@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"sync"
+)
+
+type hitCounts struct {
+	Hits   int
+	Misses int
+}
+
+// cacheStats counts cache hits and misses for CACHED commands by Redis server
+// address and by command name.
+type cacheStats struct {
+	servers  map[string]*hitCounts
+	commands map[string]*hitCounts
+	sync.Mutex
+}
+
+func (s *cacheStats) count(address, command string, hit bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.servers == nil {
+		s.servers = make(map[string]*hitCounts)
+		s.commands = make(map[string]*hitCounts)
+	}
+	for _, counts := range []*hitCounts{lookupCounts(s.servers, address), lookupCounts(s.commands, command)} {
+		if hit {
+			counts.Hits++
+		} else {
+			counts.Misses++
+		}
+	}
+}
+
+// snapshot returns copies of the current counts.
+func (s *cacheStats) snapshot() (servers, commands map[string]hitCounts) {
+	s.Lock()
+	defer s.Unlock()
+
+	servers = make(map[string]hitCounts, len(s.servers))
+	for address, counts := range s.servers {
+		servers[address] = *counts
+	}
+	commands = make(map[string]hitCounts, len(s.commands))
+	for command, counts := range s.commands {
+		commands[command] = *counts
+	}
+	return servers, commands
+}
+
+func lookupCounts(m map[string]*hitCounts, key string) *hitCounts {
+	counts, ok := m[key]
+	if !ok {
+		counts = &hitCounts{}
+		m[key] = counts
+	}
+	return counts
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"github.com/stvp/aorta/redis"
+	"strings"
+)
+
+// Cached replies are tagged with the Redis server they came from, the command
+// name, and the Redis keys they read, along with any tags given by the client
+// (see CACHED's TAG option). Tags are made of NUL-separated fields, starting
+// with the kind of tag and the server's backend key (see backendKey). Client
+// tags aren't specific to a server, so their backend key is empty.
+const (
+	backendTagKind = "backend"
+	commandTagKind = "command"
+	keyTagKind     = "key"
+	userTagKind    = "tag"
+)
+
+func backendTag(backend string) string {
+	return backendTagKind + "\x00" + backend
+}
+
+func commandTag(backend, name string) string {
+	return commandTagKind + "\x00" + backend + "\x00" + name
+}
+
+func keyTag(backend, key string) string {
+	return keyTagKind + "\x00" + backend + "\x00" + key
+}
+
+func userTag(tag string) string {
+	return userTagKind + "\x00\x00\x00" + tag
+}
+
+// parseTag returns the kind of the given tag, the address of its server, and
+// its value (the command name, Redis key, or client tag), if it has one.
+func parseTag(tag string) (kind, address, value string) {
+	fields := strings.SplitN(tag, "\x00", 4)
+	if len(fields) < 3 {
+		return "", "", ""
+	}
+	if len(fields) == 4 {
+		value = fields[3]
+	}
+	return fields[0], fields[1], value
+}
+
+// readTags returns the tags for a cached reply to the given read command: its
+// server, its command name and the Redis keys it reads, followed by the given
+// client tags. They're attached as the reply is cached (see cache.TaggedObject)
+// so that a write can't slip in between caching and tagging the reply.
+func (s *Server) readTags(args []string, conn *redis.ServerConn, clientTags []string) []string {
+	backend := s.backendKey(conn)
+	name := strings.ToUpper(args[0])
+	tags := []string{backendTag(backend), commandTag(backend, name)}
+	if spec, ok := readCommands[name]; ok {
+		for _, k := range spec.keys(args) {
+			tags = append(tags, keyTag(backend, k))
+		}
+	}
+	return append(tags, clientTags...)
+}
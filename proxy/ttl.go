@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"github.com/stvp/aorta/cache"
+	"github.com/stvp/aorta/redis"
+	"github.com/stvp/resp"
+	"strings"
+	"time"
+)
+
+// fetch runs the given command for the cache fill of a CACHED or CACHEDSTALE
+// command. With KeyTTL, a command that reads a single key is sent along with
+// PTTL for the key, and the reply is wrapped in a cache.ExpiringObject if the
+// key has a TTL so that it isn't cached for longer than the key exists. Error
+// replies listed in NegativeErrors are returned as replies instead of errors,
+// so that they're cached.
+func (s *Server) fetch(ctx context.Context, command resp.Command, conn *redis.ServerConn) (response resp.Object, err error) {
+	key, ok := s.ttlKey(command)
+	if !ok {
+		response, err = conn.DoContext(ctx, command)
+	} else {
+		var expires map[string]time.Time
+		response, expires, err = s.doWithTTLs(ctx, command, []string{key}, conn)
+		if at, ok := expires[key]; ok {
+			response = cache.ExpiringObject{Object: response, Expires: at}
+		}
+	}
+	if s.negativeError(err) {
+		return response, nil
+	}
+	return response, err
+}
+
+// ttlKey returns the Redis key read by the given command if KeyTTL is set and
+// the command reads exactly one key.
+func (s *Server) ttlKey(command resp.Command) (string, bool) {
+	if !s.KeyTTL {
+		return "", false
+	}
+	args, err := command.Strings()
+	if err != nil || len(args) == 0 {
+		return "", false
+	}
+	spec, ok := readCommands[strings.ToUpper(args[0])]
+	if !ok {
+		return "", false
+	}
+	keys := spec.keys(args)
+	if len(keys) != 1 {
+		return "", false
+	}
+	return keys[0], true
+}
+
+// doWithTTLs runs the given command along with PTTL for each of the given
+// Redis keys in a single round trip. It returns the command's reply and the
+// expiry time of each key that has a TTL. Keys that don't exist or don't
+// expire are left out.
+func (s *Server) doWithTTLs(ctx context.Context, command resp.Command, keys []string, conn *redis.ServerConn) (resp.Object, map[string]time.Time, error) {
+	commands := []resp.Command{command}
+	for _, key := range keys {
+		commands = append(commands, resp.NewCommand("PTTL", key))
+	}
+	start := time.Now()
+	responses, err := conn.DoPipelineContext(ctx, commands...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e, ok := responses[0].(resp.Error); ok {
+		return responses[0], nil, e
+	}
+
+	expires := make(map[string]time.Time)
+	for i, key := range keys {
+		if ms, ok := redis.IntegerValue(responses[i+1]); ok && ms >= 0 {
+			// Measure from when the command was sent, to err on the side of
+			// expiring early
+			expires[key] = start.Add(time.Duration(ms) * time.Millisecond)
+		}
+	}
+	return responses[0], expires, nil
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stvp/resp"
+	. "github.com/stvp/stvp/log/helpers"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A WarmupCommand is a CACHED command from a warmup file. See ParseWarmup.
+type WarmupCommand struct {
+	Line      int
+	Addresses []string
+	Password  string
+	MaxAge    time.Duration
+	Args      []string
+}
+
+// ParseWarmup reads a warmup file. Warmup files list the commands to cache in
+// the same form that clients send them: PROXY lines select the server for the
+// CACHED lines that follow them.
+//
+//	# Reference data
+//	PROXY 10.0.0.1 6379 password
+//	CACHED 3600 HGETALL currencies
+//	CACHED 3600 GET "site name"
+//
+// Arguments are separated by spaces and may be double-quoted, with Go escape
+// sequences. Blank lines and lines starting with # are ignored.
+func ParseWarmup(r io.Reader) ([]WarmupCommand, error) {
+	var commands []WarmupCommand
+	var addresses []string
+	var password string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		args, err := splitArgs(text)
+		if err != nil {
+			return nil, fmt.Errorf("aorta: warmup line %d: %s", line, err)
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PROXY":
+			// PROXY host port auth [host port ...]
+			if len(args) < 4 || len(args)%2 != 0 {
+				return nil, fmt.Errorf("aorta: warmup line %d: wrong number of arguments for 'proxy'", line)
+			}
+			addresses = []string{fmt.Sprintf("%s:%s", args[1], args[2])}
+			for i := 4; i < len(args); i += 2 {
+				addresses = append(addresses, fmt.Sprintf("%s:%s", args[i], args[i+1]))
+			}
+			password = args[3]
+		case "CACHED":
+			if len(args) < 3 {
+				return nil, fmt.Errorf("aorta: warmup line %d: wrong number of arguments for 'cached'", line)
+			}
+			if addresses == nil {
+				return nil, fmt.Errorf("aorta: warmup line %d: proxy destination not set", line)
+			}
+			secs, err := strconv.Atoi(args[1])
+			if err != nil || secs < 0 {
+				return nil, fmt.Errorf("aorta: warmup line %d: invalid max age '%s'", line, args[1])
+			}
+			commands = append(commands, WarmupCommand{
+				Line:      line,
+				Addresses: addresses,
+				Password:  password,
+				MaxAge:    time.Duration(secs) * time.Second,
+				Args:      args[2:],
+			})
+		default:
+			return nil, fmt.Errorf("aorta: warmup line %d: expected PROXY or CACHED, got '%s'", line, args[0])
+		}
+	}
+	return commands, scanner.Err()
+}
+
+// splitArgs splits a line of a warmup file into arguments.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for line = strings.TrimLeft(line, " \t"); len(line) > 0; line = strings.TrimLeft(line, " \t") {
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		// Find the closing quote, skipping escaped characters
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil, errors.New("unterminated quoted argument")
+		}
+		arg, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted argument %s", line[:end+1])
+		}
+		args = append(args, arg)
+		line = line[end+1:]
+	}
+	return args, nil
+}
+
+// Warmup fills the cache with the given commands, one at a time, and returns
+// the number of commands that failed. Progress and errors are logged.
+func (s *Server) Warmup(commands []WarmupCommand) (failed int) {
+	return s.warmup(commands, nil)
+}
+
+// WarmupBackground fills the cache with the given commands in the background.
+// Until each command has been filled (or has failed), CACHED commands that
+// would have to fill it are refused with an error, so that clients don't all
+// fetch the same keys while the cache is warming up.
+func (s *Server) WarmupBackground(commands []WarmupCommand) {
+	keys := make([][]string, len(commands))
+	s.warmingMutex.Lock()
+	if s.warming == nil {
+		s.warming = make(map[string]int)
+	}
+	for i, command := range commands {
+		keys[i] = s.warmupKeys(command)
+		for _, key := range keys[i] {
+			s.warming[key]++
+		}
+	}
+	s.warmingMutex.Unlock()
+
+	go s.warmup(commands, func(i int) {
+		s.warmingMutex.Lock()
+		for _, key := range keys[i] {
+			if s.warming[key]--; s.warming[key] == 0 {
+				delete(s.warming, key)
+			}
+		}
+		s.warmingMutex.Unlock()
+	})
+}
+
+// warmup fills the cache with the given commands, calling done, if it's set,
+// with the index of each command once it's been tried.
+func (s *Server) warmup(commands []WarmupCommand, done func(int)) (failed int) {
+	INFO("Cache warmup: %d commands", len(commands))
+	start := time.Now()
+	progress := len(commands)/10 + 1
+	for i, command := range commands {
+		if err := s.warm(command); err != nil {
+			WARN("Cache warmup failed on line %d: %s", command.Line, err.Error())
+			failed++
+		}
+		if done != nil {
+			done(i)
+		}
+		if (i+1)%progress == 0 && i+1 < len(commands) {
+			INFO("Cache warmup: %d/%d commands done", i+1, len(commands))
+		}
+	}
+	INFO("Cache warmup done: %d filled, %d failed in %s", len(commands)-failed, failed, time.Since(start))
+	return failed
+}
+
+// warmingUp returns true if any of the given cache keys is waiting to be
+// filled by a background warmup and isn't already cached since maxAge.
+func (s *Server) warmingUp(keys []string, maxAge time.Time) bool {
+	s.warmingMutex.Lock()
+	var warming []string
+	for _, key := range keys {
+		if s.warming[key] > 0 {
+			warming = append(warming, key)
+		}
+	}
+	s.warmingMutex.Unlock()
+
+	for _, key := range warming {
+		if entry, ok := s.Cache.Entry(key); !ok || !entry.Timestamp.After(maxAge) {
+			return true
+		}
+	}
+	return false
+}
+
+// warmupKeys returns the cache keys that the given warmup command fills: one
+// per key or field for the commands in expandedCommands.
+func (s *Server) warmupKeys(command WarmupCommand) []string {
+	conn := s.Pool.GetFailover(command.Addresses, command.Password, s.serverTimeouts)
+	return s.cachedKeys(command.Args, conn, true)
+}
+
+// warm fills the cache for a single warmup command, in the same way as a
+// client's CACHED command.
+func (s *Server) warm(command WarmupCommand) error {
+	name := strings.ToUpper(command.Args[0])
+	if reason := s.uncacheableReason(name); len(reason) > 0 {
+		return fmt.Errorf("aorta: can't cache %s command '%s'", reason, strings.ToLower(name))
+	}
+
+	conn := s.Pool.GetFailover(command.Addresses, command.Password, s.serverTimeouts)
+	cmd := resp.NewCommand(command.Args...)
+	key := s.cacheKey(cmd, conn)
+	maxAge := time.Now().Add(-command.MaxAge)
+	deadline := s.serverTimeouts.Dial + s.serverTimeouts.Write + s.serverTimeouts.Read
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	var err error
+	if n, ok := expandedCommands[name]; ok && len(command.Args) > n {
+		_, _, err = s.expandedDo(ctx, name, command.Args, maxAge, conn, nil)
+	} else {
+		_, _, err = s.cachedDo(ctx, key, maxAge, cmd, conn, deadline, s.readTags(command.Args, conn, nil))
+	}
+	if err != nil {
+		return err
+	}
+	s.track(command.Args, conn, true)
+	return nil
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"github.com/stvp/resp"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWarmup(t *testing.T) {
+	file := `
+# Reference data
+PROXY 10.0.0.1 6379 pw
+CACHED 3600 HGETALL currencies
+
+proxy 10.0.0.2 6379 "" 10.0.0.3 6380
+  cached 60 GET "site name"
+`
+	commands, err := ParseWarmup(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []WarmupCommand{
+		{4, []string{"10.0.0.1:6379"}, "pw", time.Hour, []string{"HGETALL", "currencies"}},
+		{7, []string{"10.0.0.2:6379", "10.0.0.3:6380"}, "", time.Minute, []string{"GET", "site name"}},
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %#v, got %#v", expected, commands)
+	}
+}
+
+func TestParseWarmup_Errors(t *testing.T) {
+	tests := []struct {
+		file string
+		err  string
+	}{
+		{"CACHED 60 GET a", "aorta: warmup line 1: proxy destination not set"},
+		{"PROXY 10.0.0.1 6379", "aorta: warmup line 1: wrong number of arguments for 'proxy'"},
+		{"PROXY 10.0.0.1 6379 pw\nCACHED 60", "aorta: warmup line 2: wrong number of arguments for 'cached'"},
+		{"PROXY 10.0.0.1 6379 pw\nCACHED soon GET a", "aorta: warmup line 2: invalid max age 'soon'"},
+		{"PROXY 10.0.0.1 6379 pw\nGET a", "aorta: warmup line 2: expected PROXY or CACHED, got 'GET'"},
+		{`PROXY 10.0.0.1 6379 "pw`, "aorta: warmup line 1: unterminated quoted argument"},
+	}
+	for i, test := range tests {
+		_, err := ParseWarmup(strings.NewReader(test.file))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("tests[%d]: expected error %q, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"GET a", []string{"GET", "a"}},
+		{"  GET \t a  ", []string{"GET", "a"}},
+		{`GET "a b"`, []string{"GET", "a b"}},
+		{`GET "a \"b\"\n" c`, []string{"GET", "a \"b\"\n", "c"}},
+		{`GET ""`, []string{"GET", ""}},
+	}
+	for i, test := range tests {
+		args, err := splitArgs(test.line)
+		if err != nil {
+			t.Errorf("tests[%d]: %s", i, err)
+		} else if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("tests[%d]: expected %q, got %q", i, test.args, args)
+		}
+	}
+
+	if _, err := splitArgs(`GET "\q"`); err == nil {
+		t.Error("expected an error for an invalid escape sequence")
+	}
+}
+
+func TestWarmup_Uncacheable(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", 0, 0)
+	commands := []WarmupCommand{
+		{1, []string{"127.0.0.1:1"}, "", time.Minute, []string{"INCR", "a"}},
+	}
+	if failed := proxy.Warmup(commands); failed != 1 {
+		t.Errorf("expected 1 failed command, got %d", failed)
+	}
+}
+
+func TestWarmingUp_Expanded(t *testing.T) {
+	proxy := NewServer("0.0.0.0:12001", "pw", 0, 0)
+	command := WarmupCommand{1, []string{"127.0.0.1:1"}, "", time.Minute, []string{"MGET", "a", "b"}}
+	proxy.warming = map[string]int{}
+	for _, key := range proxy.warmupKeys(command) {
+		proxy.warming[key]++
+	}
+	conn := proxy.Pool.GetFailover(command.Addresses, command.Password, proxy.serverTimeouts)
+	maxAge := time.Now().Add(-time.Minute)
+
+	// MGETs are warmed up per key, so they overlap with any MGET of a warming
+	// key, but not with the whole command as CACHEDSTALE caches it
+	tests := []struct {
+		args    []string
+		expand  bool
+		warming bool
+	}{
+		{[]string{"MGET", "a", "b"}, true, true},
+		{[]string{"mget", "b", "c"}, true, true},
+		{[]string{"MGET", "c"}, true, false},
+		{[]string{"GET", "a"}, true, false},
+		{[]string{"MGET", "a", "b"}, false, false},
+	}
+	for i, test := range tests {
+		if warming := proxy.warmingUp(proxy.cachedKeys(test.args, conn, test.expand), maxAge); warming != test.warming {
+			t.Errorf("tests[%d]: expected warming up to be %v, got %v", i, test.warming, warming)
+		}
+	}
+
+	// Keys that are already cached aren't waiting for the warmup
+	proxy.Cache.Set(proxy.expandedCacheKey([]string{"MGET"}, "b", conn), resp.NewBulkString("2"))
+	if proxy.warmingUp(proxy.cachedKeys([]string{"MGET", "b", "c"}, conn, true), maxAge) {
+		t.Error("expected a cached key not to be warming up")
+	}
+	if !proxy.warmingUp(proxy.cachedKeys([]string{"MGET", "a", "b"}, conn, true), maxAge) {
+		t.Error("expected a key that isn't cached yet to be warming up")
+	}
+}
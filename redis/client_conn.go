@@ -2,24 +2,35 @@ package redis
 
 import (
 	"github.com/stvp/resp"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 // ClientConn is a connection to a Redis client (redis-cli, etc.)
 type ClientConn struct {
 	RESPConn
+	watched *watchedConn
 }
 
 // NewClientConn takes an open TCP connection and returns a ClientConn. The
 // given timeout is used for both reading and writing.
 func NewClientConn(conn net.Conn, timeout time.Duration) *ClientConn {
+	return NewClientConnTimeouts(conn, NewTimeouts(timeout))
+}
+
+// NewClientConnTimeouts is like NewClientConn but takes separate read and
+// write timeouts.
+func NewClientConnTimeouts(conn net.Conn, timeouts Timeouts) *ClientConn {
+	watched := newWatchedConn(conn)
 	client := &ClientConn{
 		RESPConn: RESPConn{
-			timeout: timeout,
-			conn:    conn,
-			reader:  resp.NewReaderSize(conn, 8192),
+			timeouts: timeouts,
+			conn:     watched,
+			reader:   resp.NewReaderSize(watched, 8192),
 		},
+		watched: watched,
 	}
 
 	return client
@@ -54,8 +65,65 @@ func (c *ClientConn) Write(raw []byte) error {
 	return c.write(raw)
 }
 
+// Gone returns a channel that's closed when the client closes its side of the
+// connection, even if no command is being read at the time. Clients that send
+// more commands without waiting for replies may not be noticed until those
+// commands have been read.
+func (c *ClientConn) Gone() <-chan bool {
+	return c.watched.gone
+}
+
 // WriteError takes an error message and sends it to the Redis client at a RESP
 // error object.
 func (c *ClientConn) WriteError(msg string) error {
 	return c.Write(resp.NewError(msg))
 }
+
+// A watchedConn reads from a net.Conn in the background, once the first read
+// has been made, so that a closed connection is noticed right away. Reads go
+// through an in-memory pipe so that read deadlines still work. Writes go
+// directly to the net.Conn.
+type watchedConn struct {
+	net.Conn
+	pipe net.Conn
+	once sync.Once
+	gone chan bool
+}
+
+func newWatchedConn(conn net.Conn) *watchedConn {
+	return &watchedConn{
+		Conn: conn,
+		gone: make(chan bool),
+	}
+}
+
+func (w *watchedConn) start() {
+	local, remote := net.Pipe()
+	w.pipe = local
+	go func() {
+		io.Copy(remote, w.Conn)
+		close(w.gone)
+		remote.Close()
+	}()
+}
+
+func (w *watchedConn) Read(b []byte) (int, error) {
+	w.once.Do(w.start)
+	return w.pipe.Read(b)
+}
+
+func (w *watchedConn) SetDeadline(t time.Time) error {
+	w.SetReadDeadline(t)
+	return w.Conn.SetWriteDeadline(t)
+}
+
+func (w *watchedConn) SetReadDeadline(t time.Time) error {
+	w.once.Do(w.start)
+	return w.pipe.SetReadDeadline(t)
+}
+
+func (w *watchedConn) Close() error {
+	w.once.Do(w.start)
+	w.pipe.Close()
+	return w.Conn.Close()
+}
@@ -12,6 +12,17 @@ var (
 	ErrInvalidCommandFormat = errors.New("aorta: invalid command format")
 )
 
+// IsConnError returns true if the given error is a connection error (e.g. a
+// dial error, timeout or closed connection) rather than an error returned by
+// Redis.
+func IsConnError(err error) bool {
+	if err == ErrConnClosed || err == ErrTimeout {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
 func wrapErr(err error) error {
 	if err == nil {
 		return nil
@@ -19,6 +30,8 @@ func wrapErr(err error) error {
 		return ErrConnClosed
 	} else if err.Error() == "use of closed network connection" {
 		return ErrConnClosed
+	} else if err == io.ErrClosedPipe {
+		return ErrConnClosed
 	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 		return ErrTimeout
 	} else if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
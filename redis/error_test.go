@@ -0,0 +1,26 @@
+package redis
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsConnError(t *testing.T) {
+	_, dialErr := net.DialTimeout("tcp", "0.0.0.0:9999", time.Millisecond)
+
+	connErrors := []error{ErrConnClosed, ErrTimeout, dialErr}
+	for i, err := range connErrors {
+		if !IsConnError(err) {
+			t.Errorf("connErrors[%d]: expected connection error: %#v", i, err)
+		}
+	}
+
+	otherErrors := []error{ErrInvalidCommandFormat, fmt.Errorf("ERR oops")}
+	for i, err := range otherErrors {
+		if IsConnError(err) {
+			t.Errorf("otherErrors[%d]: didn't expect connection error: %#v", i, err)
+		}
+	}
+}
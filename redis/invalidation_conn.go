@@ -0,0 +1,182 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/stvp/resp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An InvalidationConn is a connection to a Redis server that listens for
+// changes to keys. On Redis 6 and later, it uses CLIENT TRACKING in broadcast
+// mode, which reports every key change. On older servers, it falls back to
+// keyspace notifications, which must be enabled in the server's
+// notify-keyspace-events setting.
+type InvalidationConn struct {
+	conn     *ServerConn
+	tracking bool
+	done     chan bool
+	doneOnce sync.Once
+}
+
+// NewInvalidationConn returns an InvalidationConn for the Redis server at the
+// given address. It doesn't connect until Listen is called.
+func NewInvalidationConn(address, password string, timeouts Timeouts) *InvalidationConn {
+	return &InvalidationConn{
+		conn: NewFailoverServerConn([]string{address}, password, timeouts),
+		done: make(chan bool),
+	}
+}
+
+// Listen connects to the Redis server and calls fn with the keys that have
+// changed each time the server reports a change. fn is called with nil keys
+// if every key may have changed (e.g. after FLUSHALL). Listen blocks until the
+// connection fails or the InvalidationConn is closed and returns the error.
+func (c *InvalidationConn) Listen(fn func(keys []string)) error {
+	c.conn.Lock()
+	if c.Closed() {
+		c.conn.Unlock()
+		return ErrConnClosed
+	}
+	err := c.conn.dial()
+	if err == nil {
+		err = c.subscribe()
+	}
+	// Read without the lock held so that Close can close the connection to
+	// unblock the read. Close clears the ServerConn's fields, so keep our own
+	// references to the connection and its reader.
+	conn, reader := c.conn.conn, c.conn.reader
+	c.conn.Unlock()
+	if err != nil {
+		return err
+	}
+	if conn == nil {
+		return ErrConnClosed
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	for {
+		obj, err := reader.ReadObject()
+		if err != nil {
+			c.conn.Close()
+			return wrapErr(err)
+		}
+		if keys, ok := c.parse(obj); ok {
+			fn(keys)
+		}
+	}
+}
+
+// Closed returns true if the InvalidationConn has been closed.
+func (c *InvalidationConn) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the connection, causing Listen to return.
+func (c *InvalidationConn) Close() error {
+	c.doneOnce.Do(func() { close(c.done) })
+	return c.conn.Close()
+}
+
+func (c *InvalidationConn) subscribe() error {
+	id, err := c.conn.do(resp.NewCommand("CLIENT", "ID"))
+	if err == nil {
+		redirect := strings.TrimSpace(strings.TrimPrefix(string(id.Raw()), ":"))
+		_, err = c.conn.do(resp.NewCommand("CLIENT", "TRACKING", "on", "BCAST", "REDIRECT", redirect))
+	}
+	if err == nil {
+		c.tracking = true
+		return c.conn.write(resp.NewCommand("SUBSCRIBE", "__redis__:invalidate"))
+	}
+	if _, ok := err.(resp.Error); !ok {
+		return err
+	}
+
+	// CLIENT TRACKING isn't supported
+	c.tracking = false
+	return c.conn.write(resp.NewCommand("PSUBSCRIBE", "__keyspace@*__:*"))
+}
+
+// parse returns the changed keys from an invalidation message or keyspace
+// notification. Other messages (e.g. subscription confirmations) are ignored.
+func (c *InvalidationConn) parse(obj resp.Object) (keys []string, ok bool) {
+	message, ok := ArrayElements(obj)
+	if !ok || len(message) < 3 {
+		return nil, false
+	}
+
+	if c.tracking {
+		// message, __redis__:invalidate, [key, ...]
+		if bulkString(message[0]) != "message" {
+			return nil, false
+		}
+		changed, ok := ArrayElements(message[2])
+		if !ok {
+			return nil, false
+		}
+		for _, key := range changed {
+			keys = append(keys, bulkString(key))
+		}
+		return keys, true
+	}
+
+	// pmessage, pattern, __keyspace@<db>__:<key>, event
+	if len(message) < 4 || bulkString(message[0]) != "pmessage" {
+		return nil, false
+	}
+	channel := bulkString(message[2])
+	i := strings.Index(channel, "__:")
+	if i < 0 {
+		return nil, false
+	}
+	return []string{channel[i+3:]}, true
+}
+
+// ArrayElements returns the elements of a RESP array, or false if the object
+// isn't an array. A null array has nil elements.
+func ArrayElements(obj resp.Object) (elements []resp.Object, ok bool) {
+	raw := obj.Raw()
+	end := bytes.IndexByte(raw, '\n')
+	if len(raw) == 0 || raw[0] != '*' || end < 2 {
+		return nil, false
+	}
+	count, err := strconv.Atoi(string(raw[1 : end-1]))
+	if err != nil {
+		return nil, false
+	}
+
+	reader := resp.NewReaderSize(bytes.NewReader(raw[end+1:]), len(raw))
+	for i := 0; i < count; i++ {
+		element, err := reader.ReadObject()
+		if err != nil {
+			return nil, false
+		}
+		elements = append(elements, element)
+	}
+	return elements, true
+}
+
+// IntegerValue returns the value of a RESP integer, or false if the object
+// isn't an integer.
+func IntegerValue(obj resp.Object) (int64, bool) {
+	raw := obj.Raw()
+	if len(raw) < 4 || raw[0] != ':' {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(bytes.TrimRight(raw[1:], "\r\n")), 10, 64)
+	return n, err == nil
+}
+
+func bulkString(obj resp.Object) string {
+	if s, ok := obj.(resp.String); ok {
+		return s.String()
+	}
+	return ""
+}
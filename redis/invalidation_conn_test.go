@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/stvp/resp"
+	"github.com/stvp/tempredis"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readRaw(t *testing.T, raw string) resp.Object {
+	obj, err := resp.NewReaderSize(bytes.NewReader([]byte(raw)), len(raw)).ReadObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestInvalidationConnParse(t *testing.T) {
+	tracking := &InvalidationConn{tracking: true}
+	keyspace := &InvalidationConn{}
+
+	tests := []struct {
+		conn *InvalidationConn
+		raw  string
+		keys []string
+		ok   bool
+	}{
+		{tracking, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n", []string{"a", "b"}, true},
+		{tracking, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*-1\r\n", nil, true},
+		{tracking, "*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n", nil, false},
+		{keyspace, "*4\r\n$8\r\npmessage\r\n$16\r\n__keyspace@*__:*\r\n$19\r\n__keyspace@0__:user\r\n$3\r\nset\r\n", []string{"user"}, true},
+		{keyspace, "*3\r\n$10\r\npsubscribe\r\n$16\r\n__keyspace@*__:*\r\n:1\r\n", nil, false},
+		{keyspace, "+OK\r\n", nil, false},
+	}
+	for i, test := range tests {
+		keys, ok := test.conn.parse(readRaw(t, test.raw))
+		if ok != test.ok || !reflect.DeepEqual(test.keys, keys) {
+			t.Errorf("tests[%d]: expected %#v, %v, got: %#v, %v", i, test.keys, test.ok, keys, ok)
+		}
+	}
+}
+
+func TestInvalidationConnListen(t *testing.T) {
+	config := tempredis.Config{
+		"port":                   "22000",
+		"requirepass":            "pw",
+		"notify-keyspace-events": "KA",
+	}
+	tempredis.Temp(config, func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changed := make(chan []string, 10)
+		invalidator := NewInvalidationConn(goodAddress, goodAuth, NewTimeouts(time.Second))
+		done := make(chan error)
+		go func() {
+			done <- invalidator.Listen(func(keys []string) { changed <- keys })
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		conn := NewServerConn(goodAddress, goodAuth, time.Second)
+		conn.Do(resp.NewCommand("SET", "mykey", "value"))
+		select {
+		case keys := <-changed:
+			if !reflect.DeepEqual([]string{"mykey"}, keys) {
+				t.Errorf("expected mykey to change, got: %#v", keys)
+			}
+		case <-time.After(time.Second):
+			t.Error("didn't receive an invalidation message")
+		}
+
+		invalidator.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("Listen didn't return after Close")
+		}
+	})
+}
+
+// trackingServer starts a TCP server that replies to each command with the
+// next of the replies that a Redis server with CLIENT TRACKING would send to an
+// InvalidationConn, and then sends an invalidation message for the given key.
+// It returns the server's address.
+func trackingServer(t *testing.T, key string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := []string{
+		":7\r\n",
+		"+OK\r\n",
+		"*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n" +
+			"*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n",
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for i := 0; ; i++ {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					if i < len(replies) {
+						conn.Write([]byte(replies[i]))
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Run with -race to check that Close is safe to call while Listen is reading.
+func TestInvalidationConnClose(t *testing.T) {
+	address := trackingServer(t, "mykey")
+	for i := 0; i < 10; i++ {
+		invalidator := NewInvalidationConn(address, "", NewTimeouts(time.Second))
+		changed := make(chan []string, 1)
+		done := make(chan error)
+		go func() {
+			done <- invalidator.Listen(func(keys []string) { changed <- keys })
+		}()
+
+		select {
+		case keys := <-changed:
+			if !reflect.DeepEqual([]string{"mykey"}, keys) {
+				t.Errorf("expected mykey to change, got: %#v", keys)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("didn't receive an invalidation message")
+		}
+
+		invalidator.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Listen didn't return after Close")
+		}
+		if err := invalidator.Listen(func([]string) {}); err != ErrConnClosed {
+			t.Errorf("expected ErrConnClosed from Listen after Close, got: %#v", err)
+		}
+	}
+}
@@ -1,19 +1,67 @@
 package redis
 
 import (
+	"context"
 	"github.com/stvp/resp"
 	"net"
 	"sync"
 	"time"
 )
 
+// Timeouts holds the timeouts used for dialing, reading from and writing to a
+// RESPConn. Dial is only used by ServerConns.
+type Timeouts struct {
+	Dial  time.Duration
+	Read  time.Duration
+	Write time.Duration
+}
+
+// NewTimeouts returns Timeouts that use the given timeout for everything.
+func NewTimeouts(timeout time.Duration) Timeouts {
+	return Timeouts{Dial: timeout, Read: timeout, Write: timeout}
+}
+
 // A RESPConn is a TCP connection to a Redis server or client with methods for
 // reading and writing RESP.
 type RESPConn struct {
-	timeout time.Duration
-	conn    net.Conn
-	reader  *resp.Reader
-	sync.Mutex
+	timeouts Timeouts
+	conn     net.Conn
+	reader   *resp.Reader
+	ctxMutex
+}
+
+// A ctxMutex is a mutual exclusion lock that can be waited on with a
+// context.Context. The zero value is an unlocked mutex.
+type ctxMutex struct {
+	once sync.Once
+	ch   chan bool
+}
+
+func (m *ctxMutex) init() {
+	m.once.Do(func() {
+		m.ch = make(chan bool, 1)
+	})
+}
+
+func (m *ctxMutex) Lock() {
+	m.init()
+	m.ch <- true
+}
+
+// LockContext locks the mutex, or returns the context's error if the context
+// is done before the mutex can be locked.
+func (m *ctxMutex) LockContext(ctx context.Context) error {
+	m.init()
+	select {
+	case m.ch <- true:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *ctxMutex) Unlock() {
+	<-m.ch
 }
 
 // Close closes the underlying TCP connection. It waits for any currently
@@ -31,7 +79,7 @@ func (c *RESPConn) write(raw []byte) error {
 		return ErrConnClosed
 	}
 
-	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeouts.Write))
 	_, err := c.conn.Write(raw)
 	err = wrapErr(err)
 	if err == ErrConnClosed {
@@ -42,11 +90,27 @@ func (c *RESPConn) write(raw []byte) error {
 }
 
 func (c *RESPConn) readObject() (obj resp.Object, err error) {
+	return c.readObjectDeadline(time.Now().Add(c.timeouts.Read))
+}
+
+// readObjectDeadline is like readObject but uses the given read deadline
+// instead of the connection's default read timeout.
+func (c *RESPConn) readObjectDeadline(deadline time.Time) (obj resp.Object, err error) {
+	if c.conn == nil {
+		return nil, ErrConnClosed
+	}
+
+	c.conn.SetReadDeadline(deadline)
+	return c.readPending()
+}
+
+// readPending is like readObject but keeps the connection's current read
+// deadline.
+func (c *RESPConn) readPending() (obj resp.Object, err error) {
 	if c.conn == nil {
 		return nil, ErrConnClosed
 	}
 
-	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
 	obj, err = c.reader.ReadObject()
 	err = wrapErr(err)
 	if err == ErrConnClosed {
@@ -1,43 +1,123 @@
 package redis
 
 import (
+	"context"
 	"github.com/stvp/resp"
 	"net"
+	"sync"
 	"time"
 )
 
 type ServerConn struct {
 	LastUsed time.Time
-	address  string
-	password string
+
+	// RecoveryDelay is how long a ServerConn that has failed over to another
+	// address waits before trying the primary address again.
+	RecoveryDelay time.Duration
+
+	// address, active and failedOver are only changed with both the
+	// ServerConn and stateMutex locked, so they can be read with either one.
+	stateMutex sync.Mutex
+	address    string
+	addresses  []string
+	active     int
+	failedOver time.Time
+	password   string
 	RESPConn
 }
 
 func NewServerConn(address, password string, timeout time.Duration) *ServerConn {
+	return NewFailoverServerConn([]string{address}, password, NewTimeouts(timeout))
+}
+
+// NewFailoverServerConn returns a ServerConn for an ordered list of candidate
+// addresses. The first address is the primary. If dialing an address fails or
+// its connection is closed, the ServerConn fails over to the next address in
+// the list.
+func NewFailoverServerConn(addresses []string, password string, timeouts Timeouts) *ServerConn {
 	server := &ServerConn{
-		LastUsed: time.Now(),
-		address:  address,
-		password: password,
+		LastUsed:  time.Now(),
+		address:   addresses[0],
+		addresses: addresses,
+		password:  password,
 		RESPConn: RESPConn{
-			timeout: timeout,
+			timeouts: timeouts,
 		},
 	}
 	return server
 }
 
 func (s *ServerConn) Do(command resp.Command) (response resp.Object, err error) {
-	s.Lock()
+	return s.DoTimeout(command, s.timeouts.Read)
+}
+
+// DoTimeout is like Do but waits up to the given read timeout for the reply
+// instead of the ServerConn's default read timeout. It's useful for commands
+// that are known to be slow.
+func (s *ServerConn) DoTimeout(command resp.Command, readTimeout time.Duration) (response resp.Object, err error) {
+	return s.doContext(context.Background(), command, readTimeout)
+}
+
+// DoContext is like Do but gives up as soon as the given context is done,
+// whether it's waiting for another command on the ServerConn to finish or
+// waiting for a reply. If the context has a deadline, it's used as the read
+// deadline instead of the ServerConn's default read timeout. If the context is
+// canceled, its error is returned.
+func (s *ServerConn) DoContext(ctx context.Context, command resp.Command) (response resp.Object, err error) {
+	return s.doContext(ctx, command, s.timeouts.Read)
+}
+
+// DoPipelineContext is like DoContext but sends all of the given commands at
+// once and then reads their replies, so that they only take one round trip.
+// Redis error replies are returned along with the other replies instead of as
+// an error.
+func (s *ServerConn) DoPipelineContext(ctx context.Context, commands ...resp.Command) (responses []resp.Object, err error) {
+	err = s.lockAndDial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Unlock()
+
+	responses, err = s.pipelineTimeout(ctx, commands, s.timeouts.Read)
+	if err == ErrConnClosed {
+		s.next()
+	}
+	return responses, err
+}
+
+func (s *ServerConn) doContext(ctx context.Context, command resp.Command, readTimeout time.Duration) (response resp.Object, err error) {
+	err = s.lockAndDial(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer s.Unlock()
+
+	response, err = s.doTimeout(ctx, command, readTimeout)
+	if err == ErrConnClosed {
+		s.next()
+	}
+	return response, err
+}
+
+// lockAndDial locks the ServerConn and makes sure it's connected. The
+// ServerConn is only left locked if there's no error.
+func (s *ServerConn) lockAndDial(ctx context.Context) (err error) {
+	err = s.LockContext(ctx)
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	} else if err != nil {
+		return err
+	}
 	s.LastUsed = time.Now()
 
-	if s.conn == nil {
+	if s.conn == nil || s.recovering() {
 		err = s.dial()
 		if err != nil {
-			return nil, err
+			s.Unlock()
+			return err
 		}
 	}
-
-	return s.do(command)
+	return nil
 }
 
 func (s *ServerConn) Send(command resp.Command) (err error) {
@@ -45,28 +125,70 @@ func (s *ServerConn) Send(command resp.Command) (err error) {
 	defer s.Unlock()
 	s.LastUsed = time.Now()
 
-	if s.conn == nil {
+	if s.conn == nil || s.recovering() {
 		err = s.dial()
 		if err != nil {
 			return err
 		}
 	}
 
-	return s.write(command)
+	err = s.write(command)
+	if err == ErrConnClosed {
+		s.next()
+	}
+	return err
 }
 
+// Address returns the address that the ServerConn is currently using.
 func (s *ServerConn) Address() string {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
 	return s.address
 }
 
+// Addresses returns all candidate addresses, starting with the primary.
+func (s *ServerConn) Addresses() []string {
+	return s.addresses
+}
+
+// FailedOver returns true if the ServerConn is using an address other than
+// its primary address.
+func (s *ServerConn) FailedOver() bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.active > 0
+}
+
 func (s *ServerConn) Password() string {
 	return s.password
 }
 
+// dial connects to the active address, failing over to each of the following
+// addresses in turn if it can't connect. Redis errors (e.g. a bad password)
+// don't cause a failover.
 func (s *ServerConn) dial() (err error) {
 	s.close()
 
-	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if s.recovering() {
+		s.stateMutex.Lock()
+		s.active = 0
+		s.address = s.addresses[0]
+		s.stateMutex.Unlock()
+	}
+
+	for i := 0; i < len(s.addresses); i++ {
+		err = s.dialAddress()
+		if _, ok := err.(resp.Error); ok || err == nil {
+			return err
+		}
+		s.next()
+	}
+
+	return err
+}
+
+func (s *ServerConn) dialAddress() (err error) {
+	conn, err := net.DialTimeout("tcp", s.address, s.timeouts.Dial)
 	if err != nil {
 		return wrapErr(err)
 	}
@@ -84,16 +206,99 @@ func (s *ServerConn) dial() (err error) {
 	return nil
 }
 
+// next switches to the next candidate address, wrapping around to the
+// primary address after the last one. The ServerConn must be locked.
+func (s *ServerConn) next() {
+	s.close()
+	s.stateMutex.Lock()
+	s.active = (s.active + 1) % len(s.addresses)
+	s.address = s.addresses[s.active]
+	s.failedOver = time.Now()
+	s.stateMutex.Unlock()
+}
+
+// recovering returns true if the ServerConn has failed over and it's time to
+// try the primary address again.
+func (s *ServerConn) recovering() bool {
+	return s.active > 0 && time.Since(s.failedOver) >= s.RecoveryDelay
+}
+
 func (s *ServerConn) do(command resp.Command) (response resp.Object, err error) {
-	err = s.write(command)
+	return s.doTimeout(context.Background(), command, s.timeouts.Read)
+}
+
+func (s *ServerConn) doTimeout(ctx context.Context, command resp.Command, readTimeout time.Duration) (response resp.Object, err error) {
+	responses, err := s.pipelineTimeout(ctx, []resp.Command{command}, readTimeout)
 	if err != nil {
 		return nil, err
 	}
-	response, err = s.readObject()
-	if err == nil {
-		if e, ok := response.(resp.Error); ok {
-			err = e
-		}
+	response = responses[0]
+	if e, ok := response.(resp.Error); ok {
+		err = e
 	}
 	return response, err
 }
+
+// pipelineTimeout writes the given commands in a single write and then reads
+// a reply for each of them. Nothing is written if the context is already done.
+func (s *ServerConn) pipelineTimeout(ctx context.Context, commands []resp.Command, readTimeout time.Duration) (responses []resp.Object, err error) {
+	if err = ctx.Err(); err != nil {
+		if err == context.DeadlineExceeded {
+			err = ErrTimeout
+		}
+		return nil, err
+	}
+
+	var raw []byte
+	for _, command := range commands {
+		raw = append(raw, command...)
+	}
+	err = s.write(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(readTimeout)
+	}
+	s.conn.SetReadDeadline(deadline)
+
+	// Interrupt the read if the context is canceled before the reply arrives,
+	// including while the commands were being written. The read deadline is
+	// set first so that it can't undo the interruption, and the goroutine is
+	// stopped before returning so that it can't interrupt a later read.
+	if ctx.Done() != nil {
+		conn := s.conn
+		stop := make(chan bool)
+		stopped := make(chan bool)
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.SetReadDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+	}
+
+	for range commands {
+		response, err := s.readPending()
+		if err == ErrTimeout {
+			// The reply may still arrive later, so the connection can't be reused.
+			s.close()
+			if ctx.Err() == context.Canceled {
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
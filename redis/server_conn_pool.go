@@ -2,34 +2,47 @@ package redis
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
 
 type ServerConnPool struct {
-	pool         map[string]*ServerConn
-	mutexes      map[string]*sync.Mutex
-	mutexesMutex sync.Mutex
+	// RecoveryDelay is used for new ServerConns. See ServerConn.RecoveryDelay.
+	RecoveryDelay time.Duration
+
+	// OnExpire, if set, is called with each ServerConn that Expire removes
+	// from the pool, after it's closed.
+	OnExpire func(conn *ServerConn)
+
+	pool  map[string]*ServerConn
+	mutex sync.Mutex // guards pool
 }
 
 func NewServerConnPool() *ServerConnPool {
 	return &ServerConnPool{
-		pool:         map[string]*ServerConn{},
-		mutexes:      map[string]*sync.Mutex{},
-		mutexesMutex: sync.Mutex{},
+		pool: map[string]*ServerConn{},
 	}
 }
 
 func (p *ServerConnPool) Get(address, auth string, timeout time.Duration) *ServerConn {
-	key := poolKey(address, auth)
+	return p.GetFailover([]string{address}, auth, NewTimeouts(timeout))
+}
 
-	// Ensure we don't create conflicting server connections
-	p.lock(key)
-	defer p.unlock(key)
+// GetFailover returns the ServerConn for the given ordered list of candidate
+// addresses. See NewFailoverServerConn.
+func (p *ServerConnPool) GetFailover(addresses []string, auth string, timeouts Timeouts) *ServerConn {
+	key := poolKey(strings.Join(addresses, ","), auth)
+
+	// Ensure we don't create conflicting server connections. New ServerConns
+	// don't connect until they're used, so the lock is only held briefly.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
 	serverConn := p.pool[key]
 	if serverConn == nil {
-		serverConn = NewServerConn(address, auth, timeout)
+		serverConn = NewFailoverServerConn(addresses, auth, timeouts)
+		serverConn.RecoveryDelay = p.RecoveryDelay
 		p.pool[key] = serverConn
 	}
 
@@ -37,37 +50,54 @@ func (p *ServerConnPool) Get(address, auth string, timeout time.Duration) *Serve
 }
 
 func (p *ServerConnPool) Expire(limit time.Time) int {
-	expired := 0
+	var expired []*ServerConn
+	p.mutex.Lock()
 	for key, conn := range p.pool {
 		if conn.LastUsed.Before(limit) {
-			p.lock(key)
 			delete(p.pool, key)
-			delete(p.mutexes, key)
-			conn.Close()
-			expired++
+			expired = append(expired, conn)
 		}
 	}
-	return expired
+	p.mutex.Unlock()
+
+	// Closing waits for the ServerConn's current command, so it's done without
+	// the pool locked
+	for _, conn := range expired {
+		conn.Close()
+		if p.OnExpire != nil {
+			p.OnExpire(conn)
+		}
+	}
+	return len(expired)
 }
 
 func (p *ServerConnPool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	return len(p.pool)
 }
 
-func (p *ServerConnPool) lock(key string) {
-	p.mutexesMutex.Lock()
-	mutex := p.mutexes[key]
-	if mutex == nil {
-		mutex = &sync.Mutex{}
-		p.mutexes[key] = mutex
+// Conns returns all ServerConns in the pool.
+func (p *ServerConnPool) Conns() []*ServerConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conns := make([]*ServerConn, 0, len(p.pool))
+	for _, conn := range p.pool {
+		conns = append(conns, conn)
 	}
-	p.mutexesMutex.Unlock()
-	mutex.Lock()
+	return conns
 }
 
-func (p *ServerConnPool) unlock(key string) {
-	mutex := p.mutexes[key]
-	mutex.Unlock()
+// FailedOver returns all ServerConns that are currently using an address
+// other than their primary address.
+func (p *ServerConnPool) FailedOver() []*ServerConn {
+	var failedOver []*ServerConn
+	for _, conn := range p.Conns() {
+		if conn.FailedOver() {
+			failedOver = append(failedOver, conn)
+		}
+	}
+	return failedOver
 }
 
 func poolKey(address, auth string) string {
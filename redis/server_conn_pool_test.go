@@ -1,6 +1,8 @@
 package redis
 
 import (
+	"fmt"
+	"github.com/stvp/resp"
 	"sync"
 	"testing"
 	"time"
@@ -96,3 +98,53 @@ func BenchmarkServerConnPool_2_GoRoutines(b *testing.B) {
 
 	wg.Wait()
 }
+
+func TestServerConnPoolGetFailover(t *testing.T) {
+	pool := NewServerConnPool()
+	pool.RecoveryDelay = time.Minute
+	addresses := []string{"cool.com:1234", "backup.com:1234"}
+	serverConn := pool.GetFailover(addresses, "pw", NewTimeouts(time.Millisecond))
+	if serverConn.Address() != "cool.com:1234" {
+		t.Errorf("incorrect active address for ServerConn: %s", serverConn.Address())
+	}
+	if serverConn.RecoveryDelay != time.Minute {
+		t.Errorf("incorrect recovery delay for ServerConn: %s", serverConn.RecoveryDelay)
+	}
+	if pool.GetFailover(addresses, "pw", NewTimeouts(time.Millisecond)) != serverConn {
+		t.Error("subsequent GetFailover for same addresses didn't return same ServerConn")
+	}
+	if pool.Get("cool.com:1234", "pw", time.Millisecond) == serverConn {
+		t.Error("different candidate addresses should return different ServerConn, but didn't")
+	}
+}
+
+// Run with -race to check that FailedOver is safe to call while connections
+// are being added and failing over.
+func TestServerConnPoolFailedOver_Concurrent(t *testing.T) {
+	pool := NewServerConnPool()
+	conn := pool.GetFailover([]string{"127.0.0.1:1", "127.0.0.1:2"}, "", NewTimeouts(10*time.Millisecond))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			conn.Do(resp.NewCommand("PING"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			pool.Get(fmt.Sprintf("127.0.0.1:%d", 1000+i), "", time.Millisecond)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		pool.FailedOver()
+		conn.Address()
+	}
+	wg.Wait()
+
+	if n := pool.Len(); n != 21 {
+		t.Errorf("expected 21 connections, got %d", n)
+	}
+}
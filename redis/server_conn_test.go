@@ -1,8 +1,10 @@
 package redis
 
 import (
+	"context"
 	"github.com/stvp/resp"
 	"github.com/stvp/tempredis"
+	"net"
 	"reflect"
 	"testing"
 	"time"
@@ -36,6 +38,32 @@ func tempTimeoutServer(fn func(address, auth string, err error)) {
 	fn(goodAddress, goodAuth, err)
 }
 
+// silentServer starts a TCP server that accepts connections but never replies,
+// and returns its address.
+func silentServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
 // -- Tests
 
 func TestServerDo_NoAuth(t *testing.T) {
@@ -163,3 +191,167 @@ func TestServerDo_ConnectionDrop(t *testing.T) {
 		t.Errorf("expected: %#v\ngot: %#v", resp.PONG, response)
 	}
 }
+
+func TestServerDo_Failover(t *testing.T) {
+	tempredis.Temp(goodConfig, func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn := NewFailoverServerConn([]string{"0.0.0.0:9999", goodAddress}, goodAuth, NewTimeouts(time.Millisecond))
+		conn.RecoveryDelay = time.Minute
+		response, err := conn.Do(resp.NewCommand("PING"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.PONG, response) {
+			t.Errorf("expected: %#v\ngot: %#v", resp.PONG, response)
+		}
+		if conn.Address() != goodAddress {
+			t.Errorf("expected to fail over to %s, using: %s", goodAddress, conn.Address())
+		}
+		if !conn.FailedOver() {
+			t.Error("FailedOver() should be true")
+		}
+
+		// Primary is retried after the recovery delay and fails again
+		conn.RecoveryDelay = 0
+		_, err = conn.Do(resp.NewCommand("PING"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Address() != goodAddress {
+			t.Errorf("expected to fail over to %s, using: %s", goodAddress, conn.Address())
+		}
+	})
+}
+
+func TestServerDo_FailoverAllDown(t *testing.T) {
+	conn := NewFailoverServerConn([]string{"0.0.0.0:9998", "0.0.0.0:9999"}, "", NewTimeouts(time.Millisecond))
+	_, err := conn.Do(resp.NewCommand("PING"))
+	if err == nil {
+		t.Fatal("expected dial error")
+	}
+	if conn.Address() != "0.0.0.0:9998" {
+		t.Errorf("expected to wrap around to the primary address, using: %s", conn.Address())
+	}
+}
+
+func TestServerDoContext_Waiting(t *testing.T) {
+	conn := NewServerConn("0.0.0.0:9999", "", time.Millisecond)
+
+	// Simulate a long-running command
+	conn.Lock()
+	defer conn.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := conn.DoContext(ctx, resp.NewCommand("PING"))
+	if err != ErrTimeout {
+		t.Errorf("expected ErrTimeout but got %#v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = conn.DoContext(ctx, resp.NewCommand("PING"))
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled but got %#v", err)
+	}
+}
+
+func TestServerDoContext_Reading(t *testing.T) {
+	tempredis.Temp(goodConfig, func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn := NewServerConn(goodAddress, goodAuth, time.Second)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		start := time.Now()
+		_, err = conn.DoContext(ctx, resp.NewCommand("DEBUG", "SLEEP", "0.5"))
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled but got %#v", err)
+		}
+		if waited := time.Since(start); waited > 100*time.Millisecond {
+			t.Errorf("DoContext wasn't canceled promptly, waited %s", waited)
+		}
+	})
+}
+
+func TestServerDoContext_Canceled(t *testing.T) {
+	conn := NewServerConn(silentServer(t), "", time.Minute)
+	if err := conn.dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Already canceled: nothing is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if _, err := conn.pipelineTimeout(ctx, []resp.Command{resp.NewCommand("PING")}, time.Minute); err != context.Canceled {
+		t.Errorf("expected context.Canceled but got %#v", err)
+	}
+	if conn.conn == nil {
+		t.Error("expected the connection to stay open")
+	}
+
+	// Canceled while waiting for the reply, or just before the read starts
+	for _, delay := range []time.Duration{10 * time.Millisecond, 0} {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(delay)
+			cancel()
+		}()
+		_, err := conn.DoContext(ctx, resp.NewCommand("PING"))
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled but got %#v", err)
+		}
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("DoContext wasn't canceled promptly, waited %s", waited)
+	}
+}
+
+func TestServerDoPipelineContext(t *testing.T) {
+	tempredis.Temp(goodConfig, func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn := NewServerConn(goodAddress, goodAuth, time.Second)
+		conn.Do(resp.NewCommand("SET", "foo", "bar", "PX", "60000"))
+		responses, err := conn.DoPipelineContext(context.Background(),
+			resp.NewCommand("GET", "foo"),
+			resp.NewCommand("INCR", "foo"),
+			resp.NewCommand("PTTL", "foo"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responses) != 3 {
+			t.Fatalf("expected 3 responses, got: %#v", responses)
+		}
+		if expected := resp.NewBulkString("bar"); !reflect.DeepEqual(expected, responses[0]) {
+			t.Errorf("expected: %#v\ngot: %#v", expected, responses[0])
+		}
+		if _, ok := responses[1].(resp.Error); !ok {
+			t.Errorf("expected resp.Error as a response, got: %#v", responses[1])
+		}
+		if ms, ok := IntegerValue(responses[2]); !ok || ms <= 0 || ms > 60000 {
+			t.Errorf("expected a TTL, got: %#v", responses[2])
+		}
+
+		// The connection can still be used
+		response, err := conn.Do(resp.NewCommand("PING"))
+		if err != nil || !reflect.DeepEqual(resp.PONG, response) {
+			t.Errorf("expected: %#v\ngot: %#v, %#v", resp.PONG, response, err)
+		}
+	})
+}